@@ -0,0 +1,77 @@
+package miyabi
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+const (
+	// listenPIDEnvKey and listenFDsEnvKey are the environment variable names
+	// of systemd socket activation. See sd_listen_fds(3).
+	listenPIDEnvKey = "LISTEN_PID"
+	listenFDsEnvKey = "LISTEN_FDS"
+
+	// listenFDsStart is the first file descriptor passed by systemd.
+	listenFDsStart = 3
+)
+
+// ListenAndServeActivate is like ListenAndServe but serves on the sockets
+// passed by systemd socket activation instead of listening on Addr. The
+// sockets are inherited by the workers on graceful restart in the same way
+// as the listener of ListenAndServe. The first socket is reported by
+// BoundAddr.
+//
+// If the process isn't socket-activated, i.e. LISTEN_PID doesn't match the
+// pid of the process or LISTEN_FDS isn't set, it falls back to
+// ListenAndServe. The environment variables of socket activation are unset
+// so that the workers don't see them.
+func (srv *Server) ListenAndServeActivate() error {
+	if runtime.GOOS == "windows" || !srv.IsMaster() {
+		return srv.ListenAndServe()
+	}
+	listeners, err := srv.activatedListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return srv.ListenAndServe()
+	}
+	srv.extraListeners, srv.activated = listeners[1:], true
+	defer func() {
+		for _, l := range srv.extraListeners {
+			l.Close()
+		}
+		srv.extraListeners, srv.activated = nil, false
+	}()
+	return srv.supervise(context.Background(), listeners[0])
+}
+
+// activatedListeners returns the listeners of the sockets passed by systemd
+// socket activation. It returns nil if the process isn't socket-activated.
+func (srv *Server) activatedListeners() ([]listener, error) {
+	pid, err := strconv.Atoi(os.Getenv(listenPIDEnvKey))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(listenFDsEnvKey))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv(listenPIDEnvKey)
+	os.Unsetenv(listenFDsEnvKey)
+	os.Unsetenv("LISTEN_FDNAMES")
+	var listeners []listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		l, err := srv.fileListener(os.NewFile(uintptr(fd), "activated socket "+strconv.Itoa(fd)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,88 @@
+//go:build !windows
+// +build !windows
+
+package miyabi_test
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_ListenAndServeActivate(t *testing.T) {
+	var addrs []string
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServer_ListenAndServeActivateHelper$")
+	for i := 0; i < 2; i++ {
+		l := newTestListener(t)
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		addrs = append(addrs, l.Addr().String())
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	// LISTEN_PID is set by the helper itself since the pid is unknown
+	// until it's started.
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=2", "MIYABI_TEST_LOG=1", "MIYABI_TEST_ACTIVATE_ADDRS="+strings.Join(addrs, ","))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if expect := "activated\n"; !strings.Contains(string(out), expect) {
+		t.Errorf("master output => %q; want to contain %q", out, expect)
+	}
+	// The workers serve the activated sockets regardless of their Addr.
+	if unexpected := "differs from the inherited listener address"; strings.Contains(string(out), unexpected) {
+		t.Errorf("output => %q; want not to contain %q", out, unexpected)
+	}
+}
+
+func TestServer_ListenAndServeActivateHelper(t *testing.T) {
+	env := os.Getenv("MIYABI_TEST_ACTIVATE_ADDRS")
+	if env == "" {
+		return
+	}
+	addrs := strings.Split(env, ",")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	server := &miyabi.Server{Server: http.Server{Addr: "127.0.0.1:1"}}
+	states, stop := startMasterFunc(t, server.ListenAndServeActivate)
+	if actual, expect := server.BoundAddr().String(), addrs[0]; actual != expect {
+		t.Errorf("server.BoundAddr() => %v; want %v", actual, expect)
+	}
+	var pids []string
+	for _, addr := range addrs {
+		pids = append(pids, waitServing(t, addr))
+	}
+	if pids[0] != pids[1] {
+		t.Errorf("worker pids => %v; want the same worker", pids)
+	}
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	for _, addr := range addrs {
+		if actual := waitServing(t, addr); actual == pids[0] {
+			t.Errorf("worker pid on %v => %v after restart; want a new worker", addr, actual)
+		}
+	}
+	stop()
+	if !t.Failed() {
+		os.Stdout.WriteString("activated\n")
+	}
+}
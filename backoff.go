@@ -0,0 +1,54 @@
+package miyabi
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff are the initial and the maximum
+	// delays of the default AcceptBackoff, which are the same as
+	// http.Server.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// AcceptBackoff is the interface of the strategy to retry Accept on the
+// temporary errors such as running out of file descriptors.
+//
+// Next returns the delay before the next retry. It's called on every
+// consecutive temporary error. Reset is called when Accept succeeds.
+// They aren't called concurrently for the same listener.
+type AcceptBackoff interface {
+	Next() time.Duration
+	Reset()
+}
+
+// exponentialBackoff is the default AcceptBackoff that doubles the delay
+// from minAcceptBackoff up to maxAcceptBackoff.
+type exponentialBackoff struct {
+	delay time.Duration
+}
+
+func (b *exponentialBackoff) Next() time.Duration {
+	if b.delay == 0 {
+		b.delay = minAcceptBackoff
+	} else if b.delay *= 2; b.delay > maxAcceptBackoff {
+		b.delay = maxAcceptBackoff
+	}
+	return b.delay
+}
+
+func (b *exponentialBackoff) Reset() {
+	b.delay = 0
+}
+
+// isTemporary reports whether err is a temporary error of Accept, such as
+// EMFILE and ECONNABORTED. err may be wrapped by the listener.
+func isTemporary(err error) bool {
+	// Temporary is deprecated, but http.Server still relies on it for
+	// Accept.
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Temporary()
+}
@@ -0,0 +1,469 @@
+package miyabi
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minReadRateGrace is the duration to receive a request header before
+// Server.MinReadRate is enforced.
+const minReadRateGrace = time.Second
+
+// aLongTimeAgo is a non-zero time in the past used to expire deadlines.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// serverListener wraps the accepted connections in serverConn. It also
+// retries Accept on the temporary errors by Server.AcceptBackoff, and pauses
+// Accept while Server.MaxConnections is reached.
+type serverListener struct {
+	net.Listener
+
+	srv     *Server
+	backoff AcceptBackoff
+}
+
+func (l *serverListener) Accept() (net.Conn, error) {
+	if !l.srv.acquireConnSlot() {
+		addr := l.Addr()
+		return nil, &net.OpError{Op: "accept", Net: addr.Network(), Addr: addr, Err: net.ErrClosed}
+	}
+	c, err := l.Listener.Accept()
+	for err != nil && isTemporary(err) {
+		delay := l.backoff.Next()
+		l.srv.logf("miyabi: Accept error: %v; retrying in %v", err, delay)
+		time.Sleep(delay)
+		c, err = l.Listener.Accept()
+	}
+	if err != nil {
+		l.srv.releaseConnSlot()
+		return nil, err
+	}
+	l.backoff.Reset()
+	if _, ok := c.(*tls.Conn); ok {
+		// http.Server must see *tls.Conn as it is. The connection under it
+		// has been wrapped by connListener if it's accepted by the
+		// listener of Server.tlsListener.
+		return c, nil
+	}
+	return &serverConn{Conn: c, srv: l.srv}, nil
+}
+
+// connListener wraps the accepted connections in serverConn under the TLS
+// listener made by Server.tlsListener, so that MinReadRate and draining
+// apply to the TLS connections as well.
+type connListener struct {
+	net.Listener
+
+	srv *Server
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &serverConn{Conn: c, srv: l.srv}, nil
+}
+
+// multiListener accepts the connections from all of its listeners, so that
+// they are served, closed and drained together by ServeMulti.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.accept(l)
+	}
+	return ml
+}
+
+// accept passes the connections accepted from l to Accept until l fails
+// with a permanent error or ml is closed.
+func (ml *multiListener) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		select {
+		case ml.accepted <- acceptResult{c, err}:
+		case <-ml.closed:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil && !isTemporary(err) {
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.accepted:
+		return r.c, r.err
+	case <-ml.closed:
+		addr := ml.Addr()
+		return nil, &net.OpError{Op: "accept", Net: addr.Network(), Addr: addr, Err: net.ErrClosed}
+	}
+}
+
+// Close closes all of the listeners.
+func (ml *multiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.closed)
+		for _, l := range ml.listeners {
+			if cerr := l.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+// serverConn is a connection accepted by Serve.
+//
+// It can expire its read deadline while it's idle during draining.
+// http.Server reads the next request through a buffer, so a pipelined
+// request that has already been received is still served while reading
+// from the network fails immediately, and then the connection is closed by
+// http.Server.
+//
+// It also closes itself if a request header is received slower than
+// Server.MinReadRate.
+type serverConn struct {
+	net.Conn
+
+	srv *Server
+
+	mu       sync.Mutex
+	expired  bool
+	deadline time.Time
+
+	// The following fields are used to measure the rate of receiving
+	// a request header.
+	receiving bool
+	received  int64
+	start     time.Time
+	timer     *time.Timer
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.srv.MinReadRate > 0 {
+		c.mu.Lock()
+		if c.receiving {
+			if c.received == 0 {
+				c.start = time.Now()
+				c.timer = time.AfterFunc(minReadRateGrace, c.checkReadRate)
+			}
+			c.received += int64(n)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// NetConn returns the underlying connection that is wrapped by c, in the
+// same way as tls.Conn.NetConn.
+func (c *serverConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// stateChanged is called when http.Server changes the state of c.
+func (c *serverConn) stateChanged(state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A request header is received while the connection is new or idle.
+	c.receiving = state == http.StateNew || state == http.StateIdle
+	c.received = 0
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// checkReadRate closes c if the request header is being received slower
+// than Server.MinReadRate.
+func (c *serverConn) checkReadRate() {
+	c.mu.Lock()
+	if !c.receiving || c.received == 0 {
+		c.mu.Unlock()
+		return
+	}
+	rate := float64(c.received) / time.Since(c.start).Seconds()
+	if rate >= float64(c.srv.MinReadRate) {
+		c.timer.Reset(minReadRateGrace)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.srv.logf("miyabi: closing slow connection from %v: %.1f bytes/s", c.RemoteAddr(), rate)
+	c.Close()
+}
+
+// expire forces the read deadline into the past if v is true.
+// Otherwise it restores the read deadline requested by http.Server.
+func (c *serverConn) expire(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired == v {
+		return
+	}
+	c.expired = v
+	if v {
+		c.Conn.SetReadDeadline(aLongTimeAgo)
+	} else {
+		c.Conn.SetReadDeadline(c.deadline)
+	}
+}
+
+func (c *serverConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *serverConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	if c.expired {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// serverConnOf returns the serverConn of c, or nil if c isn't wrapped.
+func serverConnOf(c net.Conn) *serverConn {
+	switch c := c.(type) {
+	case *serverConn:
+		return c
+	case *tls.Conn:
+		sc, _ := c.NetConn().(*serverConn)
+		return sc
+	}
+	return nil
+}
+
+// responseWriter records whether the response has begun, so that closing
+// the connection forcibly can tell the truncated responses. It's passed to
+// the handlers by wrap, which keeps the optional interfaces of the wrapped
+// http.ResponseWriter.
+type responseWriter struct {
+	http.ResponseWriter
+
+	// wrote is set to non-zero when the header is written.
+	wrote int32
+
+	// onBegin is the optional function called when the response begins,
+	// before the header is written.
+	onBegin func(header http.Header)
+}
+
+// begin marks the response as begun.
+func (w *responseWriter) begin() {
+	if atomic.CompareAndSwapInt32(&w.wrote, 0, 1) && w.onBegin != nil {
+		w.onBegin(w.Header())
+	}
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	// 1xx informational responses don't begin the final response.
+	if code >= 200 {
+		w.begin()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.begin()
+	return w.ResponseWriter.Write(p)
+}
+
+// began reports whether the response has begun.
+func (w *responseWriter) began() bool {
+	return atomic.LoadInt32(&w.wrote) != 0
+}
+
+func (w *responseWriter) Flush() {
+	w.begin()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReadFrom lets io.Copy and http.ServeContent use sendfile(2) of the wrapped
+// http.ResponseWriter.
+func (w *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.begin()
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the original http.ResponseWriter for
+// http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// unwrapper is http.ResponseWriter that has Unwrap, which is embedded in the
+// result of wrap.
+type unwrapper interface {
+	http.ResponseWriter
+
+	Unwrap() http.ResponseWriter
+}
+
+// wrap returns w with only the optional interfaces that the wrapped
+// http.ResponseWriter implements among http.Flusher, http.Hijacker,
+// http.Pusher and io.ReaderFrom, so that the handlers can detect them as
+// usual.
+func (w *responseWriter) wrap() http.ResponseWriter {
+	_, f := w.ResponseWriter.(http.Flusher)
+	_, h := w.ResponseWriter.(http.Hijacker)
+	_, p := w.ResponseWriter.(http.Pusher)
+	_, r := w.ResponseWriter.(io.ReaderFrom)
+	type (
+		F = http.Flusher
+		H = http.Hijacker
+		P = http.Pusher
+		R = io.ReaderFrom
+	)
+	switch {
+	case f && h && p && r:
+		return struct {
+			unwrapper
+			F
+			H
+			P
+			R
+		}{w, w, w, w, w}
+	case f && h && p:
+		return struct {
+			unwrapper
+			F
+			H
+			P
+		}{w, w, w, w}
+	case f && h && r:
+		return struct {
+			unwrapper
+			F
+			H
+			R
+		}{w, w, w, w}
+	case f && p && r:
+		return struct {
+			unwrapper
+			F
+			P
+			R
+		}{w, w, w, w}
+	case h && p && r:
+		return struct {
+			unwrapper
+			H
+			P
+			R
+		}{w, w, w, w}
+	case f && h:
+		return struct {
+			unwrapper
+			F
+			H
+		}{w, w, w}
+	case f && p:
+		return struct {
+			unwrapper
+			F
+			P
+		}{w, w, w}
+	case f && r:
+		return struct {
+			unwrapper
+			F
+			R
+		}{w, w, w}
+	case h && p:
+		return struct {
+			unwrapper
+			H
+			P
+		}{w, w, w}
+	case h && r:
+		return struct {
+			unwrapper
+			H
+			R
+		}{w, w, w}
+	case p && r:
+		return struct {
+			unwrapper
+			P
+			R
+		}{w, w, w}
+	case f:
+		return struct {
+			unwrapper
+			F
+		}{w, w}
+	case h:
+		return struct {
+			unwrapper
+			H
+		}{w, w}
+	case p:
+		return struct {
+			unwrapper
+			P
+		}{w, w}
+	case r:
+		return struct {
+			unwrapper
+			R
+		}{w, w}
+	}
+	return struct{ unwrapper }{w}
+}
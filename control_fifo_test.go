@@ -0,0 +1,163 @@
+//go:build !windows
+// +build !windows
+
+package miyabi_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func writeCommand(t *testing.T, path, command string) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(command + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_Serve_controlFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control")
+	server := &miyabi.Server{ControlFIFO: path}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("ControlFIFO mode => %v; want named pipe", fi.Mode())
+	}
+	writeCommand(t, path, "unknown")
+	writeCommand(t, path, "shutdown")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(ControlFIFO) after shutdown => %v; want not exist", err)
+	}
+}
+
+func TestServer_ListenAndServe_controlFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control")
+	server := &miyabi.Server{
+		Server:      http.Server{Addr: freeAddr(t)},
+		ControlFIFO: path,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	writeCommand(t, path, "restart")
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+}
+
+func TestServer_ListenAndServe_rebind(t *testing.T) {
+	var buf syncBuffer
+	path := filepath.Join(t.TempDir(), "control")
+	server := &miyabi.Server{
+		Server:      http.Server{Addr: freeAddr(t)},
+		ControlFIFO: path,
+		Logger:      log.New(&buf, "", 0),
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	// The address is still bound by the worker.
+	writeCommand(t, path, "rebind")
+	deadline := time.Now().Add(5 * time.Second)
+	for expect := "rebind failed"; !strings.Contains(buf.String(), expect); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("logged %q; want to contain %q", buf.String(), expect)
+		}
+	}
+	if actual := waitServing(t, server.Addr); actual != pid {
+		t.Errorf("worker pid => %v after failed rebind; want %v", actual, pid)
+	}
+	select {
+	case state := <-states:
+		t.Errorf("state => %v after failed rebind; want no change", state)
+	default:
+	}
+}
+
+func TestServer_ListenAndServe_rebindUnix(t *testing.T) {
+	dir := t.TempDir()
+	path, sock := filepath.Join(dir, "control"), filepath.Join(dir, "sock")
+	server := &miyabi.Server{
+		Server:      http.Server{Addr: "unix:" + sock},
+		ControlFIFO: path,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+		DisableKeepAlives: true,
+	}}
+	get := func() string {
+		res, err := client.Get("http://miyabi/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	pid := get()
+	if err := os.Remove(sock); err != nil {
+		t.Fatal(err)
+	}
+	writeCommand(t, path, "rebind")
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := get(); actual == pid {
+		t.Errorf("worker pid => %v after rebind; want a new worker", actual)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package miyabi
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// watchControlFIFO creates ControlFIFO and starts watching it for the
+// commands. It returns the channel that receives the actions of the
+// commands and the function to stop watching and remove the FIFO. If
+// ControlFIFO is empty, it does nothing and returns nil channel.
+func (srv *Server) watchControlFIFO() (<-chan Action, func(), error) {
+	path := srv.ControlFIFO
+	if path == "" {
+		return nil, func() {}, nil
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		// Remove the FIFO left by the previous run.
+		if fi.Mode()&os.ModeNamedPipe == 0 {
+			return nil, nil, fmt.Errorf("miyabi: ControlFIFO %s exists and isn't a FIFO", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, nil, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	// Opening for reading and writing doesn't block until a writer opens
+	// the FIFO, and keeps it from reaching EOF when a writer closes it.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, err
+	}
+	commands := make(chan Action)
+	quit := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			command := strings.TrimSpace(scanner.Text())
+			if command == "" {
+				continue
+			}
+			action, ok := controlCommands[command]
+			if !ok {
+				srv.logf("miyabi: unknown command %q from ControlFIFO", command)
+				continue
+			}
+			select {
+			case commands <- action:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return commands, func() {
+		close(quit)
+		f.Close()
+		os.Remove(path)
+	}, nil
+}
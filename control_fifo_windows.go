@@ -0,0 +1,11 @@
+package miyabi
+
+import "errors"
+
+// watchControlFIFO isn't supported on Windows.
+func (srv *Server) watchControlFIFO() (<-chan Action, func(), error) {
+	if srv.ControlFIFO == "" {
+		return nil, func() {}, nil
+	}
+	return nil, nil, errors.New("miyabi: ControlFIFO is not supported on windows")
+}
@@ -0,0 +1,14 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd
+// +build linux dragonfly freebsd netbsd openbsd
+
+package miyabi
+
+import "syscall"
+
+// recvmsgCloexec is syscall.Recvmsg that receives the file descriptors with
+// close-on-exec set atomically, so that they don't leak to the processes
+// forked concurrently.
+func recvmsgCloexec(fd int, p, oob []byte) (n, oobn int, err error) {
+	n, oobn, _, _, err = syscall.Recvmsg(fd, p, oob, syscall.MSG_CMSG_CLOEXEC)
+	return n, oobn, err
+}
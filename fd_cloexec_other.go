@@ -0,0 +1,27 @@
+//go:build !windows && !linux && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !windows,!linux,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package miyabi
+
+import "syscall"
+
+// recvmsgCloexec is syscall.Recvmsg that sets close-on-exec on the received
+// file descriptors. MSG_CMSG_CLOEXEC isn't available, so it holds
+// syscall.ForkLock until they are marked in the same way as os.Pipe, so that
+// they don't leak to the processes forked concurrently.
+func recvmsgCloexec(fd int, p, oob []byte) (n, oobn int, err error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	n, oobn, _, _, err = syscall.Recvmsg(fd, p, oob, 0)
+	if err != nil {
+		return n, oobn, err
+	}
+	msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	for i := range msgs {
+		fds, _ := syscall.ParseUnixRights(&msgs[i])
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+		}
+	}
+	return n, oobn, nil
+}
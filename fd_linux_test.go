@@ -0,0 +1,147 @@
+package miyabi_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_FDTransport_unixSocket(t *testing.T) {
+	server := &miyabi.Server{
+		Server:      http.Server{Addr: freeAddr(t)},
+		FDTransport: miyabi.UnixSocketFD,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if err := server.Restart(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case state := <-states:
+				if state != miyabi.StateRestart {
+					t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+			if actual := waitServing(t, server.Addr); actual == pid {
+				t.Fatalf("worker pid => %v after restart; want a new one", actual)
+			} else {
+				pid = actual
+			}
+		}
+		environ, err := os.ReadFile("/proc/" + pid + "/environ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := miyabi.FDEnvKey + "=socket:3"
+		if !bytes.Contains(environ, []byte("\x00"+expect+"\x00")) {
+			t.Errorf("worker %v environment => %q; want to contain %q", pid, environ, expect)
+		}
+	}
+}
+
+func TestServer_FDTransport_unixSocket_oldWorkerExits(t *testing.T) {
+	killed := make(chan int, 1)
+	server := &miyabi.Server{
+		Server:      http.Server{Addr: freeAddr(t)},
+		FDTransport: miyabi.UnixSocketFD,
+		Timeout:     10 * time.Second,
+		OnForceKill: func(pid int) {
+			killed <- pid
+		},
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+
+	// Sending the listener mustn't put the socket shared with the old
+	// worker into blocking mode. Otherwise the old worker blocks in
+	// accept(2) after accepting the connection below while the new one is
+	// starting, and it never exits by itself.
+	server.ChildEnv = append(os.Environ(), "MIYABI_TEST_STARTUP_DELAY=1s")
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if actual := waitServing(t, server.Addr); actual != pid {
+		t.Fatalf("worker pid => %v while the new worker is starting; want %v", actual, pid)
+	}
+	if !listenerNonblocking(t, pid, server.Addr) {
+		t.Errorf("listener of the old worker %v is in blocking mode; want non-blocking", pid)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case pid := <-killed:
+		t.Errorf("old worker %v has been killed; want to exit gracefully", pid)
+	default:
+	}
+}
+
+// listenerNonblocking reports whether the socket listening on addr in the
+// process pid is in non-blocking mode.
+func listenerNonblocking(t *testing.T, pid, addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := os.ReadFile("/proc/" + pid + "/net/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inode string
+	for _, line := range strings.Split(string(tcp), "\n")[1:] {
+		// The fields are sl, local_address, rem_address, st, ..., inode.
+		fields := strings.Fields(line)
+		if len(fields) > 9 && strings.HasSuffix(fields[1], fmt.Sprintf(":%04X", n)) && fields[3] == "0A" {
+			inode = fields[9]
+		}
+	}
+	entries, err := os.ReadDir("/proc/" + pid + "/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if link, _ := os.Readlink("/proc/" + pid + "/fd/" + e.Name()); link != "socket:["+inode+"]" {
+			continue
+		}
+		info, err := os.ReadFile("/proc/" + pid + "/fdinfo/" + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(info), "\n") {
+			if v, ok := strings.CutPrefix(line, "flags:"); ok {
+				flags, err := strconv.ParseInt(strings.TrimSpace(v), 8, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return flags&syscall.O_NONBLOCK != 0
+			}
+		}
+	}
+	t.Fatalf("listener on %v isn't found in process %v", addr, pid)
+	return false
+}
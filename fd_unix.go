@@ -0,0 +1,118 @@
+//go:build !windows
+// +build !windows
+
+package miyabi
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// checkListenerFile returns an error unless file is a socket in listening
+// state. If bound is true, a socket that is only bound is also accepted, as
+// the reserved socket of ReusePort.
+func checkListenerFile(file *os.File, bound bool) error {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var accepting int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		accepting, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	}); err != nil {
+		return err
+	}
+	switch {
+	case serr == syscall.ENOTSOCK:
+		return errors.New("not a socket")
+	case serr != nil:
+		return os.NewSyscallError("getsockopt", serr)
+	case accepting == 0 && !bound:
+		return errors.New("socket isn't listening")
+	}
+	return nil
+}
+
+// socketPair returns a connected pair of unix sockets to send the listeners
+// to the worker with UnixSocketFD.
+func socketPair() (sock, peer *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "fd socket"), os.NewFile(uintptr(fds[1]), "fd socket"), nil
+}
+
+// sendFDs sends the file descriptors of files over the unix socket sock one
+// by one, and then closes sock to tell the end. The file descriptors are
+// taken through SyscallConn as startProcess does, since File.Fd would put
+// the listening socket shared with the running worker into blocking mode.
+func sendFDs(sock *os.File, files []*os.File) error {
+	defer sock.Close()
+	rc, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		frc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var cerr, serr error
+		if err := frc.Control(func(ffd uintptr) {
+			cerr = rc.Control(func(fd uintptr) {
+				serr = syscall.Sendmsg(int(fd), []byte{0}, syscall.UnixRights(int(ffd)), nil, 0)
+			})
+		}); err != nil {
+			return err
+		}
+		if cerr != nil {
+			return cerr
+		}
+		if serr != nil {
+			return os.NewSyscallError("sendmsg", serr)
+		}
+	}
+	return nil
+}
+
+// receiveFDs receives the file descriptors sent by sendFDs over the unix
+// socket fd until the end, and then closes fd.
+func receiveFDs(fd int) ([]uintptr, error) {
+	defer syscall.Close(fd)
+	var fds []uintptr
+	for {
+		oob := make([]byte, syscall.CmsgSpace(4))
+		n, oobn, err := recvmsgCloexec(fd, make([]byte, 1), oob)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("recvmsg", err)
+		}
+		if n == 0 {
+			break
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			return nil, errors.New("no file descriptor in the message")
+		}
+		rights, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil || len(rights) != 1 {
+			return nil, errors.New("no file descriptor in the message")
+		}
+		fds = append(fds, uintptr(rights[0]))
+	}
+	if len(fds) == 0 {
+		return nil, errors.New("no listener has been sent")
+	}
+	return fds, nil
+}
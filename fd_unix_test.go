@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package miyabi_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/naoina/miyabi"
+)
+
+// dupFile returns a duplicate of the file descriptor of f that is inherited
+// as MIYABI_FD.
+func dupFile(t *testing.T, f *os.File) int {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestServer_ListenAndServe_invalidFD(t *testing.T) {
+	const key = "MIYABI_TEST_INVALID_FD"
+	for _, v := range []struct {
+		value  string
+		expect string
+	}{
+		{"garbage", `"garbage" in MIYABI_TEST_INVALID_FD="garbage"`},
+		{"1", `"1" in MIYABI_TEST_INVALID_FD="1"`},
+		{"3,-1", `"-1" in MIYABI_TEST_INVALID_FD="3,-1"`},
+	} {
+		t.Setenv(key, v.value)
+		server := &miyabi.Server{
+			Server:   http.Server{Addr: "127.0.0.1:0"},
+			FDEnvKey: key,
+		}
+		err := server.ListenAndServe()
+		if !errors.Is(err, miyabi.ErrInvalidFD) {
+			t.Errorf("%s=%q: ListenAndServe() => %v; want %v", key, v.value, err, miyabi.ErrInvalidFD)
+			continue
+		}
+		if actual := err.Error(); !strings.Contains(actual, v.expect) {
+			t.Errorf("%s=%q: ListenAndServe() => %q; want to contain %q", key, v.value, actual, v.expect)
+		}
+	}
+}
+
+func TestServer_ListenAndServe_notListener(t *testing.T) {
+	const key = "MIYABI_TEST_NOT_LISTENER_FD"
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pf, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	for _, v := range []struct {
+		file   *os.File
+		expect string
+	}{
+		{f, "not a socket"},
+		{pf, "socket isn't listening"},
+	} {
+		fd := strconv.Itoa(dupFile(t, v.file))
+		t.Setenv(key, fd)
+		server := &miyabi.Server{
+			Server:   http.Server{Addr: "127.0.0.1:0"},
+			FDEnvKey: key,
+		}
+		err := server.ListenAndServe()
+		if !errors.Is(err, miyabi.ErrInvalidFD) {
+			t.Errorf("%s: ListenAndServe() => %v; want %v", v.file.Name(), err, miyabi.ErrInvalidFD)
+			continue
+		}
+		expect := fmt.Sprintf("%s in %s=%q: listen socket 127.0.0.1:0: %s", fd, key, fd, v.expect)
+		if actual := err.Error(); !strings.Contains(actual, expect) {
+			t.Errorf("%s: ListenAndServe() => %q; want to contain %q", v.file.Name(), actual, expect)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package miyabi
+
+import (
+	"errors"
+	"os"
+)
+
+// checkListenerFile does nothing since the listener isn't inherited on
+// Windows.
+func checkListenerFile(file *os.File, bound bool) error {
+	return nil
+}
+
+// errUnixSocketFD is returned since UnixSocketFD isn't supported on Windows.
+var errUnixSocketFD = errors.New("miyabi: UnixSocketFD isn't supported on windows")
+
+func socketPair() (sock, peer *os.File, err error) {
+	return nil, nil, errUnixSocketFD
+}
+
+func sendFDs(sock *os.File, files []*os.File) error {
+	sock.Close()
+	return errUnixSocketFD
+}
+
+func receiveFDs(fd int) ([]uintptr, error) {
+	return nil, errUnixSocketFD
+}
@@ -0,0 +1,13 @@
+package miyabi_test
+
+import (
+	"os"
+	"testing"
+)
+
+// dupFile skips the test since the file descriptors can't be inherited on
+// windows.
+func dupFile(t *testing.T, f *os.File) int {
+	t.Skip("inheriting file descriptors isn't supported on windows")
+	return 0
+}
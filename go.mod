@@ -0,0 +1,3 @@
+module github.com/naoina/miyabi
+
+go 1.21
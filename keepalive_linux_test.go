@@ -0,0 +1,135 @@
+package miyabi_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+// keepAliveOf returns SO_KEEPALIVE and TCP_KEEPIDLE of c in seconds.
+func keepAliveOf(t *testing.T, c net.Conn) (bool, int) {
+	if c, ok := c.(interface{ NetConn() net.Conn }); ok {
+		return keepAliveOf(t, c.NetConn())
+	}
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled, idle int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		if enabled, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); serr != nil {
+			return
+		}
+		idle, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return enabled != 0, idle
+}
+
+func TestServer_KeepAlivePeriod(t *testing.T) {
+	for _, v := range []struct {
+		period  time.Duration
+		enabled bool
+		idle    int
+	}{
+		{0, true, 180},
+		{30 * time.Second, true, 30},
+		{-1, false, 0},
+	} {
+		func() {
+			l := newTestListener(t)
+			defer l.Close()
+			defer inheritListener(t, l)()
+			conns := make(chan net.Conn, 1)
+			server := &miyabi.Server{
+				Server: http.Server{
+					Addr: l.Addr().String(),
+					ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+						conns <- c
+						return ctx
+					},
+				},
+				KeepAlivePeriod: v.period,
+			}
+			go server.ListenAndServe()
+			defer server.Shutdown(context.Background())
+			res, err := http.Get("http://" + l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			enabled, idle := keepAliveOf(t, <-conns)
+			if enabled != v.enabled {
+				t.Errorf("KeepAlivePeriod %v: SO_KEEPALIVE => %v; want %v", v.period, enabled, v.enabled)
+			}
+			if v.enabled && idle != v.idle {
+				t.Errorf("KeepAlivePeriod %v: TCP_KEEPIDLE => %v; want %v", v.period, idle, v.idle)
+			}
+		}()
+	}
+}
+
+// noDelayOf returns TCP_NODELAY of c.
+func noDelayOf(t *testing.T, c net.Conn) bool {
+	if c, ok := c.(interface{ NetConn() net.Conn }); ok {
+		return noDelayOf(t, c.NetConn())
+	}
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noDelay int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		noDelay, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return noDelay != 0
+}
+
+func TestServer_NoDelay(t *testing.T) {
+	// TCP_NODELAY is set in both cases since it's the default of the net
+	// package.
+	for _, noDelay := range []bool{false, true} {
+		func() {
+			l := newTestListener(t)
+			defer l.Close()
+			defer inheritListener(t, l)()
+			conns := make(chan net.Conn, 1)
+			server := &miyabi.Server{
+				Server: http.Server{
+					Addr: l.Addr().String(),
+					ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+						conns <- c
+						return ctx
+					},
+				},
+				NoDelay: noDelay,
+			}
+			go server.ListenAndServe()
+			defer server.Shutdown(context.Background())
+			res, err := http.Get("http://" + l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if actual := noDelayOf(t, <-conns); !actual {
+				t.Errorf("NoDelay %v: TCP_NODELAY => %v; want true", noDelay, actual)
+			}
+		}()
+	}
+}
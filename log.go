@@ -0,0 +1,105 @@
+package miyabi
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Logger is the interface for logging of Server.
+// *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogConfig logs the effective configuration of the server.
+// It does nothing if no logger is set.
+func (srv *Server) LogConfig() {
+	if srv.logger() == nil {
+		return
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	mode := "master"
+	switch {
+	case runtime.GOOS == "windows":
+		mode = "disabled"
+	case !srv.IsMaster():
+		mode = "worker"
+	}
+	config := []string{
+		fmt.Sprintf("addr=%s", addr),
+		fmt.Sprintf("tls=%v", srv.TLSConfig != nil),
+		fmt.Sprintf("supervision=%s", mode),
+		fmt.Sprintf("signals=%s", formatSignals(srv.signalActions())),
+		fmt.Sprintf("timeout=%v", srv.timeout()),
+		fmt.Sprintf("keep_alive_period=%v", srv.keepAlivePeriod()),
+		fmt.Sprintf("drain_timeout=%v", srv.baseDrainTimeout()),
+		fmt.Sprintf("drain_timeout_per_conn=%v", srv.DrainTimeoutPerConn),
+		fmt.Sprintf("drain_max_timeout=%v", srv.DrainMaxTimeout),
+		fmt.Sprintf("drain_hard_timeout=%v", srv.DrainHardTimeout),
+		fmt.Sprintf("drain_idle_timeout=%v", srv.DrainIdleTimeout),
+		fmt.Sprintf("health_path=%q", srv.healthPath()),
+		fmt.Sprintf("pre_shutdown_delay=%v", srv.preShutdownDelay()),
+		fmt.Sprintf("post_listen_close_delay=%v", srv.PostListenCloseDelay),
+	}
+	if srv.MasterUser != "" || srv.MasterGroup != "" {
+		config = append(config, fmt.Sprintf("master_credential=%s:%s", srv.MasterUser, srv.MasterGroup))
+	}
+	srv.logf("miyabi: config: %s", strings.Join(config, " "))
+}
+
+// formatSignals formats actions in a stable order.
+func formatSignals(actions map[os.Signal]Action) string {
+	var sigs []string
+	for sig, action := range actions {
+		sigs = append(sigs, fmt.Sprintf("%v:%v", sig, action))
+	}
+	sort.Strings(sigs)
+	return strings.Join(sigs, ",")
+}
+
+// logf writes a log message to the logger if it's set.
+func (srv *Server) logf(format string, args ...interface{}) {
+	if l := srv.logger(); l != nil {
+		l.Printf(format, args...)
+	}
+}
+
+func (srv *Server) logger() Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	if srv.ErrorLog != nil {
+		return srv.ErrorLog
+	}
+	return nil
+}
+
+// setState calls StateChanged, or ServerState if it's nil, with state, and
+// logs the runtime statistics if LogRuntimeStats is enabled.
+func (srv *Server) setState(state State) {
+	srv.logRuntimeStats(state.String())
+	switch {
+	case srv.StateChanged != nil:
+		srv.StateChanged(state)
+	case ServerState != nil:
+		ServerState(state)
+	}
+}
+
+// logRuntimeStats logs the number of goroutines and the memory statistics
+// with event if LogRuntimeStats is enabled.
+func (srv *Server) logRuntimeStats(event string) {
+	if !srv.LogRuntimeStats {
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	srv.logf("miyabi: runtime stats: event=%s pid=%d goroutines=%d heap_alloc=%d heap_objects=%d sys=%d num_gc=%d",
+		event, os.Getpid(), runtime.NumGoroutine(), m.HeapAlloc, m.HeapObjects, m.Sys, m.NumGC)
+}
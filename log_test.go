@@ -0,0 +1,76 @@
+package miyabi_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_LogConfig(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server:       http.Server{Addr: "127.0.0.1:8080"},
+		Logger:       log.New(&buf, "", 0),
+		DrainTimeout: 5 * time.Second,
+	}
+	server.LogConfig()
+	actual := buf.String()
+	for _, expect := range []string{
+		"addr=127.0.0.1:8080",
+		"tls=false",
+		"supervision=master",
+		"signals=hangup:ActionRestart,interrupt:ActionShutdown,terminated:ActionShutdown",
+		"timeout=3m0s",
+		"keep_alive_period=3m0s",
+		"drain_timeout=5s",
+	} {
+		if !strings.Contains(actual, expect) {
+			t.Errorf("LogConfig() logged %q; want to contain %q", actual, expect)
+		}
+	}
+}
+
+func TestServer_LogConfig_noLogger(t *testing.T) {
+	server := &miyabi.Server{}
+	server.LogConfig()
+}
+
+func TestServer_LogRuntimeStats(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		LogRuntimeStats: true,
+		Logger:          log.New(&buf, "", 0),
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server = &miyabi.Server{
+		Server:          http.Server{Addr: freeAddr(t)},
+		LogRuntimeStats: true,
+		Logger:          log.New(&buf, "", 0),
+	}
+	_, stop := startMaster(t, server)
+	stop()
+	actual := buf.String()
+	for _, event := range []string{"serve_start", "serve_done", "StateStart", "StateShutdown"} {
+		if expect := "event=" + event + " "; !strings.Contains(actual, expect) {
+			t.Errorf("logged %q; want to contain %q", actual, expect)
+		}
+	}
+	if expect := "goroutines="; !strings.Contains(actual, expect) {
+		t.Errorf("logged %q; want to contain %q", actual, expect)
+	}
+}
@@ -0,0 +1,61 @@
+package miyabi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// writePidFile writes the PID of the master to PidFile. The file left by
+// the previous run is replaced unless the process in it is still running.
+func (srv *Server) writePidFile() error {
+	if srv.PidFile == "" {
+		return nil
+	}
+	if b, err := os.ReadFile(srv.PidFile); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid > 0 && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("miyabi: PID file %s is used by the running process %d", srv.PidFile, pid)
+		}
+		srv.logf("miyabi: replacing stale PID file %s", srv.PidFile)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// Write to a temporary file and rename it, so that the readers never
+	// see the partial content.
+	f, err := os.CreateTemp(filepath.Dir(srv.PidFile), filepath.Base(srv.PidFile)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), srv.PidFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// removePidFile removes PidFile if it still has the PID of the master.
+func (srv *Server) removePidFile() {
+	if srv.PidFile == "" {
+		return
+	}
+	b, err := os.ReadFile(srv.PidFile)
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(srv.PidFile); err != nil {
+		srv.logf("miyabi: removing PID file: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package miyabi_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_MasterUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root privilege")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	// The workers are executed as nobody, so the test binary must be
+	// accessible from nobody.
+	dir, err := os.MkdirTemp("", "miyabi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	prog := filepath.Join(dir, "miyabi.test")
+	if err := copyFile(prog, os.Args[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The PID file is written and removed by nobody.
+	run := filepath.Join(dir, "run")
+	if err := os.Mkdir(run, 0755); err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if err := os.Chown(run, uid, gid); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"nobody", u.Uid} {
+		cmd := exec.Command(prog, "-test.run=^TestServer_MasterUserHelper$")
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"MIYABI_TEST_MASTER_USER="+name,
+			"MIYABI_TEST_ADDR="+freeAddr(t),
+			"MIYABI_TEST_PID_FILE="+filepath.Join(run, "miyabi.pid"))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("MasterUser %q: %v: %s", name, err, out)
+		}
+		// The supplementary groups of root are dropped.
+		expect := fmt.Sprintf("uid=%s gid=%s groups=[]\nPID file removed\n", u.Uid, u.Gid)
+		if !strings.Contains(string(out), expect) {
+			t.Errorf("MasterUser %q: master output => %q; want to contain %q", name, out, expect)
+		}
+	}
+}
+
+func TestServer_MasterUserHelper(t *testing.T) {
+	masterUser := os.Getenv("MIYABI_TEST_MASTER_USER")
+	if masterUser == "" {
+		return
+	}
+	addr, pidFile := os.Getenv("MIYABI_TEST_ADDR"), os.Getenv("MIYABI_TEST_PID_FILE")
+	started := make(chan string, 1)
+	origServerState := miyabi.ServerState
+	miyabi.ServerState = func(state miyabi.State) {
+		if state == miyabi.StateStart {
+			groups, _ := os.Getgroups()
+			started <- fmt.Sprintf("uid=%d gid=%d groups=%v", os.Getuid(), os.Getgid(), groups)
+		}
+	}
+	defer func() {
+		miyabi.ServerState = origServerState
+	}()
+	server := &miyabi.Server{
+		Server:     http.Server{Addr: addr},
+		MasterUser: masterUser,
+		PidFile:    pidFile,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	var credentials string
+	select {
+	case credentials = <-started:
+	case err := <-done:
+		t.Fatal(err)
+	}
+	waitServing(t, addr)
+	signalSelf(t, miyabi.ShutdownSignal)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(credentials)
+	if _, err := os.Stat(pidFile); os.IsNotExist(err) {
+		fmt.Println("PID file removed")
+	}
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
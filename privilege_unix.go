@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package miyabi
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the credentials of the current process to
+// MasterUser and MasterGroup.
+func (srv *Server) dropPrivileges() error {
+	if srv.MasterUser == "" && srv.MasterGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if srv.MasterUser != "" {
+		var err error
+		if uid, gid, err = lookupUser(srv.MasterUser); err != nil {
+			return err
+		}
+	}
+	if srv.MasterGroup != "" {
+		var err error
+		if gid, err = lookupGroup(srv.MasterGroup); err != nil {
+			return err
+		}
+	}
+	if gid < 0 {
+		// Otherwise the primary group of the current user would be kept.
+		return fmt.Errorf("miyabi: primary group of user %s is unknown; set MasterGroup", srv.MasterUser)
+	}
+	// The groups must be changed first because changing uid loses the
+	// privilege to change them. The supplementary groups of the current
+	// user are dropped.
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("miyabi: setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("miyabi: setgid: %v", err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("miyabi: setuid: %v", err)
+		}
+	}
+	return nil
+}
+
+// lookupUser returns uid and primary gid of the user.
+// If name is a numeric uid that isn't in the user database, it's used as is
+// and gid will be -1.
+func lookupUser(name string) (uid, gid int, err error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		u, err := user.LookupId(name)
+		if err != nil {
+			return uid, -1, nil
+		}
+		gid, err := strconv.Atoi(u.Gid)
+		if err != nil {
+			return -1, -1, err
+		}
+		return uid, gid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, -1, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return -1, -1, err
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup returns gid of the group.
+// If name is a numeric gid, it's used as is.
+func lookupGroup(name string) (gid int, err error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,11 @@
+package miyabi
+
+import "errors"
+
+// dropPrivileges isn't supported on Windows.
+func (srv *Server) dropPrivileges() error {
+	if srv.MasterUser == "" && srv.MasterGroup == "" {
+		return nil
+	}
+	return errors.New("miyabi: MasterUser and MasterGroup are not supported on windows")
+}
@@ -0,0 +1,12 @@
+package miyabi
+
+import "syscall"
+
+// sysProcAttr returns the attributes of the worker process, which is killed
+// by the parent-death signal when the master dies if killWithParent is true.
+func sysProcAttr(killWithParent bool) *syscall.SysProcAttr {
+	if !killWithParent {
+		return nil
+	}
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
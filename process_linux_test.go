@@ -0,0 +1,83 @@
+package miyabi_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+// processRunning reports whether the process of pid is running, excluding
+// a zombie that hasn't been reaped by its new parent.
+func processRunning(pid string) bool {
+	b, err := os.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(b[bytes.LastIndexByte(b, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestServer_KillChildWithParent(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, "-test.run=^TestServer_KillChildWithParentHelper$")
+	cmd.Env = append(os.Environ(), "MIYABI_TEST_KILL_WITH_PARENT=1")
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the worker pid from the master: %v", err)
+	}
+	pid := strings.TrimPrefix(strings.TrimSpace(line), "worker ")
+	if !processRunning(pid) {
+		t.Fatalf("worker %v isn't running", pid)
+	}
+	if err := cmd.Process.Signal(syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+			t.Fatalf("worker %v is left running after the master is killed", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_KillChildWithParentHelper(t *testing.T) {
+	if os.Getenv("MIYABI_TEST_KILL_WITH_PARENT") == "" {
+		return
+	}
+	server := &miyabi.Server{
+		Server:              http.Server{Addr: freeAddr(t)},
+		KillChildWithParent: true,
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	fmt.Printf("worker %s\n", waitServing(t, server.Addr))
+	// Wait to be killed.
+	time.Sleep(time.Minute)
+}
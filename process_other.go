@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package miyabi
+
+import "syscall"
+
+// sysProcAttr returns nil since the parent-death signal isn't supported on
+// this platform.
+func sysProcAttr(killWithParent bool) *syscall.SysProcAttr {
+	return nil
+}
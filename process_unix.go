@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package miyabi
+
+import (
+	"os"
+	"syscall"
+)
+
+// startProcess starts the program name with the files as os.StartProcess.
+// If killWithParent is true, the process is killed when the current process
+// dies, where it's supported.
+//
+// os.StartProcess calls File.Fd, which puts the file into blocking mode. It
+// would make the listening socket shared with the running worker blocking,
+// and then the worker might block in accept(2) and never shut down. So the
+// file descriptors are taken through SyscallConn, which doesn't change the
+// mode.
+func startProcess(name string, argv []string, dir string, env []string, files []*os.File, killWithParent bool) (*os.Process, error) {
+	fds := make([]uintptr, len(files))
+	for i, f := range files {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		if err := rc.Control(func(fd uintptr) {
+			fds[i] = fd
+		}); err != nil {
+			return nil, err
+		}
+	}
+	pid, _, err := syscall.StartProcess(name, argv, &syscall.ProcAttr{
+		Dir:   dir,
+		Env:   env,
+		Files: fds,
+		Sys:   sysProcAttr(killWithParent),
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "fork/exec", Path: name, Err: err}
+	}
+	return os.FindProcess(pid)
+}
+
+// processExists reports whether the process of pid exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
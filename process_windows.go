@@ -0,0 +1,23 @@
+package miyabi
+
+import "os"
+
+// startProcess starts the program name with the files. killWithParent is
+// ignored since it isn't supported on Windows.
+func startProcess(name string, argv []string, dir string, env []string, files []*os.File, killWithParent bool) (*os.Process, error) {
+	return os.StartProcess(name, argv, &os.ProcAttr{
+		Dir:   dir,
+		Env:   env,
+		Files: files,
+	})
+}
+
+// processExists reports whether the process of pid exists.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
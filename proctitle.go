@@ -0,0 +1,35 @@
+package miyabi
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// maxProcessTitleLen is the maximum length of the process title.
+const maxProcessTitleLen = 15
+
+// setWorkerTitle sets the process title of the worker if ProcessTitle is
+// true.
+func (srv *Server) setWorkerTitle() {
+	if !srv.ProcessTitle {
+		return
+	}
+	gen := os.Getenv(generationEnvKey)
+	if gen == "" {
+		return
+	}
+	setProcessTitle(processTitle("w" + gen))
+}
+
+// processTitle returns the process title for role. The program name is
+// truncated so that the title fits in maxProcessTitleLen.
+func processTitle(role string) string {
+	name := filepath.Base(os.Args[0])
+	if n := maxProcessTitleLen - len(role) - 1; len(name) > n {
+		if n < 0 {
+			n = 0
+		}
+		name = name[:n]
+	}
+	return name + " " + role
+}
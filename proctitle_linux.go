@@ -0,0 +1,13 @@
+package miyabi
+
+import "os"
+
+// setProcessTitle sets the name of the process that is shown by ps and
+// top. /proc/self/comm is the name of the main thread, which represents the
+// process.
+func setProcessTitle(title string) {
+	if f, err := os.OpenFile("/proc/self/comm", os.O_WRONLY, 0); err == nil {
+		f.WriteString(title)
+		f.Close()
+	}
+}
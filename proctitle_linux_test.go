@@ -0,0 +1,47 @@
+package miyabi_test
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func readComm(t *testing.T, pid string) string {
+	b, err := os.ReadFile("/proc/" + pid + "/comm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestServer_ProcessTitle(t *testing.T) {
+	orig := readComm(t, "self")
+	defer os.WriteFile("/proc/self/comm", []byte(orig), 0)
+	server := &miyabi.Server{
+		Server:       http.Server{Addr: freeAddr(t)},
+		ProcessTitle: true,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	if actual, expect := readComm(t, "self"), " master"; !strings.HasSuffix(actual, expect) {
+		t.Errorf("master title => %q; want suffix %q", actual, expect)
+	}
+	pid := waitServing(t, server.Addr)
+	if actual, expect := readComm(t, pid), " w1"; !strings.HasSuffix(actual, expect) {
+		t.Errorf("worker title => %q; want suffix %q", actual, expect)
+	}
+	signalSelf(t, miyabi.RestartSignal)
+	select {
+	case <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	pid = waitServing(t, server.Addr)
+	if actual, expect := readComm(t, pid), " w2"; !strings.HasSuffix(actual, expect) {
+		t.Errorf("restarted worker title => %q; want suffix %q", actual, expect)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package miyabi
+
+// setProcessTitle isn't supported on this platform.
+func setProcessTitle(title string) {}
@@ -0,0 +1,279 @@
+package miyabi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is the maximum duration to receive the PROXY
+	// protocol header.
+	proxyHeaderTimeout = 10 * time.Second
+
+	// proxyV1MaxLen is the maximum length of the PROXY protocol v1 header
+	// including CRLF.
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Signature is the signature of the PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errInvalidProxyHeader is returned when the PROXY protocol header is
+// missing or malformed.
+var errInvalidProxyHeader = errors.New("miyabi: invalid PROXY protocol header")
+
+// proxyListener reads the PROXY protocol header of each accepted connection
+// in its own goroutine, and Accept returns the connections whose header has
+// been read as proxyConn. So a client that is slow to send the header
+// doesn't block Accept, and RemoteAddr of the returned connection never
+// blocks. The connections with an invalid header are closed. *tls.Conn
+// and proxyConn are returned as they are since their header has already
+// been read by the listener under them.
+type proxyListener struct {
+	net.Listener
+
+	srv       *Server
+	startOnce sync.Once
+	accepted  chan acceptResult
+	closed    chan struct{}
+
+	// mu guards pending, the connections whose header is being read, which
+	// are closed with the listener.
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+}
+
+func newProxyListener(l net.Listener, srv *Server) *proxyListener {
+	return &proxyListener{
+		Listener: l,
+		srv:      srv,
+		accepted: make(chan acceptResult),
+		closed:   make(chan struct{}),
+		pending:  make(map[net.Conn]struct{}),
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() {
+		go l.accept()
+	})
+	select {
+	case r := <-l.accepted:
+		return r.c, r.err
+	case <-l.closed:
+		addr := l.Addr()
+		return nil, &net.OpError{Op: "accept", Net: addr.Network(), Addr: addr, Err: net.ErrClosed}
+	}
+}
+
+// accept accepts the connections and starts reading their header until the
+// underlying listener fails with a permanent error or l is closed. The
+// errors are passed to Accept.
+func (l *proxyListener) accept() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- acceptResult{nil, err}:
+			case <-l.closed:
+				return
+			}
+			if !isTemporary(err) {
+				return
+			}
+			continue
+		}
+		l.mu.Lock()
+		if l.pending == nil {
+			l.mu.Unlock()
+			c.Close()
+			return
+		}
+		l.pending[c] = struct{}{}
+		l.mu.Unlock()
+		go l.readHeader(c)
+	}
+}
+
+// readHeader reads the PROXY protocol header of c and passes the connection
+// to Accept.
+func (l *proxyListener) readHeader(c net.Conn) {
+	pc, err := c, error(nil)
+	switch c.(type) {
+	case *tls.Conn, *proxyConn:
+	default:
+		p := &proxyConn{Conn: c}
+		err = p.readHeader()
+		pc = p
+	}
+	l.mu.Lock()
+	delete(l.pending, c)
+	l.mu.Unlock()
+	if err != nil {
+		select {
+		case <-l.closed:
+			// c has been closed with the listener.
+		default:
+			l.srv.logf("miyabi: closing connection from %v: %v", c.RemoteAddr(), err)
+			c.Close()
+		}
+		return
+	}
+	select {
+	case l.accepted <- acceptResult{pc, nil}:
+	case <-l.closed:
+		pc.Close()
+	}
+}
+
+// Close closes the listener and the connections whose header is being read.
+func (l *proxyListener) Close() error {
+	l.mu.Lock()
+	if l.pending != nil {
+		close(l.closed)
+		for c := range l.pending {
+			c.Close()
+		}
+		l.pending = nil
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection that begins with the PROXY protocol header,
+// which has been read by proxyListener. RemoteAddr returns the address of
+// the client in it.
+type proxyConn struct {
+	net.Conn
+
+	br         *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// readHeader reads the PROXY protocol header within proxyHeaderTimeout.
+// It's called before the connection is passed to the caller of Accept, so
+// the read deadline is cleared afterwards without overriding the deadline of
+// the caller, e.g. ReadHeaderTimeout of http.Server.
+func (c *proxyConn) readHeader() error {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(c.Conn)
+	addr, err := readProxyHeader(br)
+	c.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	c.br, c.remoteAddr = br, addr
+	return nil
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// RemoteAddr returns the address of the client in the PROXY protocol
+// header, or the address of the peer if the header doesn't have it.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection that is wrapped by c.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header from br and
+// returns the source address in it. It returns nil address for the header
+// without the address, e.g. the health checks of the proxy.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	if b, err := br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(br)
+	}
+	if b, err := br.Peek(6); err != nil || string(b) != "PROXY " {
+		return nil, errInvalidProxyHeader
+	}
+	return readProxyHeaderV1(br)
+}
+
+// readProxyHeaderV1 reads the text header of the PROXY protocol v1, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errInvalidProxyHeader
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, errInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header of the PROXY protocol v2.
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	version, command, family := header[12]>>4, header[12]&0x0f, header[13]
+	if version != 2 || command > 1 {
+		return nil, errInvalidProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+	if command == 0 {
+		// LOCAL command is sent by the proxy itself.
+		return nil, nil
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// The other families don't have the TCP address of the client.
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: short address of %d bytes", errInvalidProxyHeader, len(payload))
+	}
+	ip := net.IP(append([]byte(nil), payload[:ipLen]...))
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,208 @@
+package miyabi_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RemoteAddr)
+		})},
+		ProxyProtocol: true,
+	}
+	l := newTestListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ServeContext(ctx, l)
+	if err := server.WaitReady(context.Background()); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+	v2 := func(command, family byte, addr ...byte) string {
+		return "\r\n\r\n\x00\r\nQUIT\n" + string([]byte{0x20 | command, family, 0, byte(len(addr))}) + string(addr)
+	}
+	for _, v := range []struct {
+		header string
+		expect string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{v2(1, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb), "192.0.2.1:56324"},
+		{v2(1, 0x21,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0xdc, 0x04, 0x01, 0xbb), "[2001:db8::1]:56324"},
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, v.header+"GET / HTTP/1.0\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("header %q: %v", v.header, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual, expect := string(body), v.expect; actual != expect {
+			t.Errorf("header %q: RemoteAddr => %q; want %q", v.header, actual, expect)
+		}
+	}
+
+	// The proxy sends the LOCAL command for the health checks.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, v2(0, 0)+"GET / HTTP/1.0\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("LOCAL command: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	conn.Close()
+	if actual, expect := string(body), conn.LocalAddr().String(); actual != expect {
+		t.Errorf("LOCAL command: RemoteAddr => %q; want %q", actual, expect)
+	}
+
+	for _, header := range []string{
+		"",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n",
+		"PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		v2(1, 0x11, 192, 0, 2, 1),
+		v2(2, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb),
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, header+"GET / HTTP/1.0\r\n\r\n")
+		if res, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+			t.Errorf("header %q: response %v; want connection closed", header, res.Status)
+		}
+		conn.Close()
+	}
+}
+
+func TestServer_ProxyProtocol_slowClient(t *testing.T) {
+	newAddrs := make(chan string, 10)
+	server := &miyabi.Server{
+		Server: http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.RemoteAddr)
+			}),
+			ConnState: func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					newAddrs <- c.RemoteAddr().String()
+				}
+			},
+			ReadHeaderTimeout: 200 * time.Millisecond,
+		},
+		ProxyProtocol: true,
+	}
+	l := newTestListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ServeContext(ctx, l)
+	if err := server.WaitReady(context.Background()); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+
+	// The client that doesn't send the header doesn't block the others.
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET / HTTP/1.0\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case addr := <-newAddrs:
+		if expect := "192.0.2.1:56324"; addr != expect {
+			t.Errorf("RemoteAddr in StateNew => %q; want %q", addr, expect)
+		}
+	default:
+		t.Error("ConnState hasn't been called with StateNew")
+	}
+
+	// ReadHeaderTimeout takes effect after the PROXY protocol header.
+	slow, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	io.WriteString(slow, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET / HTTP/1.1\r\n")
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.Copy(io.Discard, slow)
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("connection with the incomplete request header is kept for %v; want to be closed by ReadHeaderTimeout", elapsed)
+	}
+}
+
+func TestServer_ProxyProtocol_TLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTLSFiles(t, dir, newTestCertificate(t), newTestCertificate(t))
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RemoteAddr)
+		})},
+		ProxyProtocol: true,
+	}
+	l := newTestListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ServeTLS(l, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err := server.WaitReady(context.Background()); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+	defer server.Shutdown(ctx)
+
+	// The header precedes the TLS handshake.
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(raw, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, expect := string(body), "192.0.2.1:56324"; actual != expect {
+		t.Errorf("RemoteAddr => %q; want %q", actual, expect)
+	}
+}
@@ -0,0 +1,316 @@
+package miyabi_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_Restart_fileError(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		Logger: log.New(&buf, "", 0),
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirFD := strconv.Itoa(int(dir.Fd()))
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := map[string]bool{}
+	for _, name := range names {
+		open[name] = true
+	}
+	delete(open, dirFD)
+	// Limit the file descriptors below the lowest free one, so that the
+	// master fails to duplicate the listener by File.
+	limit := rlimit
+	for limit.Cur = 0; open[strconv.FormatUint(limit.Cur, 10)]; limit.Cur++ {
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	restored := false
+	restore := func() {
+		if !restored {
+			restored = true
+			if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	defer restore()
+	if err := server.Restart(); err != nil {
+		t.Fatalf("server.Restart() => %v; want nil", err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestartFailed {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestartFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	restore()
+	if actual := waitServing(t, server.Addr); actual != pid {
+		t.Errorf("worker pid => %v after failed restart; want %v", actual, pid)
+	}
+	if expect := "passing the listener to the worker"; !strings.Contains(buf.String(), expect) {
+		t.Errorf("log => %q; want to contain %q", buf.String(), expect)
+	}
+}
+
+// openFDs returns the file descriptors open in the process pid, except the
+// one to read them in the current process.
+func openFDs(t *testing.T, pid string) map[string]bool {
+	dir, err := os.Open("/proc/" + pid + "/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirFD := strconv.Itoa(int(dir.Fd()))
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds := map[string]bool{}
+	for _, name := range names {
+		fds[name] = true
+	}
+	if pid == "self" {
+		delete(fds, dirFD)
+	}
+	return fds
+}
+
+func TestServer_Restart_fdLeak(t *testing.T) {
+	const n = 10
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	states, stop := startMaster(t, server)
+	defer stop()
+	restart := func() string {
+		if err := server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case state := <-states:
+			if state != miyabi.StateRestart {
+				t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return waitServing(t, server.Addr)
+	}
+	// The first restart opens the files that are kept afterwards, e.g. the
+	// ones of the runtime.
+	pid := restart()
+	master, worker := len(openFDs(t, "self")), len(openFDs(t, pid))
+	for i := 0; i < n; i++ {
+		pid = restart()
+	}
+	if actual := len(openFDs(t, pid)); actual != worker {
+		t.Errorf("worker has %v open fds after %v restarts; want %v", actual, n, worker)
+	}
+	// The old worker may be still exiting.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		actual := len(openFDs(t, "self"))
+		if actual <= master {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("master has %v open fds after %v restarts; want at most %v", actual, n, master)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// childStates returns the states of the child processes of the current
+// process by their pids, e.g. "Z" for a zombie.
+func childStates(t *testing.T) map[string]string {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := strconv.Itoa(os.Getpid())
+	states := map[string]string{}
+	for _, stat := range stats {
+		b, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The fields after the command name in parentheses are the state
+		// and the parent pid.
+		fields := strings.Fields(string(b[bytes.LastIndexByte(b, ')')+1:]))
+		if len(fields) > 1 && fields[1] == self {
+			states[filepath.Base(filepath.Dir(stat))] = fields[0]
+		}
+	}
+	return states
+}
+
+// childPids returns the pids of the child processes of the current process
+// that are still running.
+func childPids(t *testing.T) map[string]bool {
+	pids := map[string]bool{}
+	for pid, state := range childStates(t) {
+		if state != "Z" {
+			pids[pid] = true
+		}
+	}
+	return pids
+}
+
+func TestServer_Restart_canceledByShutdown(t *testing.T) {
+	// Long enough not to be confused with the exit of the workers, which
+	// takes a second under the race detector.
+	const delay = 3 * time.Second
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server:   http.Server{Addr: freeAddr(t)},
+		Logger:   log.New(&buf, "", 0),
+		ChildEnv: append(os.Environ(), "MIYABI_TEST_STARTUP_DELAY="+delay.String()),
+	}
+	before := childPids(t)
+	states, stop := startMaster(t, server)
+	waitServing(t, server.Addr)
+	signalSelf(t, miyabi.RestartSignal)
+	// Wait for the new worker to be started.
+	for !strings.Contains(buf.String(), "restarting worker") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed >= delay/2 {
+		t.Errorf("shutdown took %v; want the restart to be canceled", elapsed)
+	}
+	for len(states) > 0 {
+		if state := <-states; state != miyabi.StateShutdown {
+			t.Errorf("state => %v; want %v only", state, miyabi.StateShutdown)
+		}
+	}
+	if expect := "restart canceled by shutdown"; !strings.Contains(buf.String(), expect) {
+		t.Errorf("log => %q; want to contain %q", buf.String(), expect)
+	}
+	for pid := range childPids(t) {
+		if !before[pid] {
+			t.Errorf("worker %v is left running after shutdown", pid)
+		}
+	}
+}
+
+func TestServer_Restart_noZombies(t *testing.T) {
+	n := 100
+	if testing.Short() {
+		n = 10
+	}
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		// Don't let the race detector delay the exit of each worker.
+		ChildEnv: append(os.Environ(), "GORACE=atexit_sleep_ms=0"),
+	}
+	before := childStates(t)
+	states, stop := startMaster(t, server)
+	defer stop()
+	waitServing(t, server.Addr)
+	for i := 0; i < n; i++ {
+		if err := server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case state := <-states:
+			if state != miyabi.StateRestart {
+				t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		// The old worker has been reaped by the time the restart is
+		// reported.
+		var children []string
+		for pid, state := range childStates(t) {
+			if _, ok := before[pid]; !ok {
+				children = append(children, pid+":"+state)
+			}
+		}
+		if len(children) != 1 || strings.HasSuffix(children[0], ":Z") {
+			t.Fatalf("child processes after %d restarts => %v; want only the running worker", i+1, children)
+		}
+	}
+}
+
+func TestServer_Restart_killRace(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+	server := &miyabi.Server{
+		Server:   http.Server{Addr: freeAddr(t)},
+		Timeout:  timeout,
+		ChildEnv: append(os.Environ(), "GORACE=atexit_sleep_ms=0"),
+		Logger:   log.New(io.Discard, "", 0),
+	}
+	before := childStates(t)
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	for i := 0; i < n; i++ {
+		// The old worker finishes the request and exits around the time
+		// it's killed, so that the exit races with the timer to kill it.
+		d := timeout - 10*time.Millisecond + time.Duration(i%5)*5*time.Millisecond
+		res, err := http.Get(fmt.Sprintf("http://%s/sleep?d=%v", server.Addr, d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case state := <-states:
+			if state != miyabi.StateRestart {
+				t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		newPID := waitServing(t, server.Addr)
+		if newPID == pid {
+			t.Fatalf("worker pid => %v after restart; want a new worker", newPID)
+		}
+		pid = newPID
+		for child, state := range childStates(t) {
+			if _, ok := before[child]; !ok && child != pid {
+				t.Fatalf("child process %v (%v) is left after restart; want only worker %v", child, state, pid)
+			}
+		}
+	}
+}
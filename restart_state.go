@@ -0,0 +1,55 @@
+package miyabi
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	inheritedStateOnce sync.Once
+	inheritedState     []byte
+	inheritedStateErr  error
+	restartStateOnce   sync.Once
+)
+
+// InheritedState returns the state that the old worker has returned from
+// Server.RestartState on graceful restart. It returns nil if the current
+// process is the first worker, the old worker has no RestartState or the
+// current process isn't a worker.
+//
+// The state is available after the old worker has exited, so InheritedState
+// blocks until then. Note that the old worker is stopped only after the new
+// worker has become ready in Serve, so it must not be called before Serve
+// in the same goroutine.
+func InheritedState() ([]byte, error) {
+	inheritedStateOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(inheritedStateFDEnvKey))
+		if err != nil {
+			return
+		}
+		f := os.NewFile(uintptr(fd), "inherited state pipe")
+		defer f.Close()
+		inheritedState, inheritedStateErr = io.ReadAll(f)
+		if len(inheritedState) == 0 {
+			inheritedState = nil
+		}
+	})
+	return inheritedState, inheritedStateErr
+}
+
+// writeRestartState passes the state b to the master in order to be
+// inherited by the next worker. It does nothing if the current process
+// isn't a worker or has already passed the state.
+func writeRestartState(b []byte) {
+	restartStateOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(stateFDEnvKey))
+		if err != nil {
+			return
+		}
+		f := os.NewFile(uintptr(fd), "state pipe")
+		f.Write(b)
+		f.Close()
+	})
+}
@@ -0,0 +1,64 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+// +build !mips,!mipsle,!mips64,!mips64le
+
+package miyabi_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+// soReusePort is SO_REUSEPORT on Linux.
+const soReusePort = 0xf
+
+func listenReusePort(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func TestServer_ReusePort(t *testing.T) {
+	server := &miyabi.Server{
+		Server:    http.Server{Addr: freeAddr(t)},
+		ReusePort: true,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	if l, err := net.Listen("tcp", server.Addr); err == nil {
+		l.Close()
+		t.Errorf("net.Listen on the port held by the master => nil; want error")
+	}
+	l, err := listenReusePort(server.Addr)
+	if err != nil {
+		t.Fatalf("listen with SO_REUSEPORT on the port of the server => %v; want nil", err)
+	}
+	l.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+}
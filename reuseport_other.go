@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package miyabi
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// reservePort returns an error since SO_REUSEPORT isn't supported.
+func reservePort(network, addr string) (listener, error) {
+	return nil, fmt.Errorf("miyabi: ReusePort isn't supported on %s", runtime.GOOS)
+}
+
+// reusePortListener returns an error since SO_REUSEPORT isn't supported.
+func (srv *Server) reusePortListener(file *os.File) (listener, error) {
+	file.Close()
+	return nil, fmt.Errorf("miyabi: ReusePort isn't supported on %s", runtime.GOOS)
+}
+
+// reservedPort is never created on this platform.
+type reservedPort struct {
+	listener
+}
@@ -0,0 +1,209 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package miyabi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEPORT on the socket before binding it.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// reservePort binds a TCP socket with SO_REUSEPORT on addr but doesn't
+// listen on it, so that the master holds the port without receiving the
+// connections, which are accepted by the sockets that the workers bind on the
+// same port by themselves.
+func reservePort(network, addr string) (listener, error) {
+	laddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := bindReusePort(network, laddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: os.NewSyscallError("bind", err)}
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	return &reservedPort{fd: fd, addr: sockaddrToTCPAddr(sa)}, nil
+}
+
+// bindReusePort returns a socket bound on laddr with SO_REUSEPORT. The
+// wildcard address of "tcp" network is bound in dual-stack mode if IPv6 is
+// available, as the net package does.
+func bindReusePort(network string, laddr *net.TCPAddr) (int, error) {
+	var sa syscall.Sockaddr
+	family := syscall.AF_INET6
+	if network == "tcp4" && laddr.IP == nil {
+		laddr = &net.TCPAddr{IP: net.IPv4zero, Port: laddr.Port}
+	}
+	if ip4 := laddr.IP.To4(); ip4 != nil && network != "tcp6" {
+		sa4 := &syscall.SockaddrInet4{Port: laddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa, family = sa4, syscall.AF_INET
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: laddr.Port}
+		copy(sa6.Addr[:], laddr.IP)
+		if laddr.Zone != "" {
+			if ifi, err := net.InterfaceByName(laddr.Zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		sa = sa6
+	}
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err == syscall.EAFNOSUPPORT && network == "tcp" && laddr.IP == nil {
+		return bindReusePort("tcp4", laddr)
+	}
+	if err != nil {
+		return -1, err
+	}
+	if err := setReusePortOpts(fd, family == syscall.AF_INET6, network == "tcp6"); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// setReusePortOpts sets SO_REUSEADDR and SO_REUSEPORT on fd, and
+// IPV6_V6ONLY to v6only if ipv6 is true.
+func setReusePortOpts(fd int, ipv6, v6only bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+		return err
+	}
+	if !ipv6 {
+		return nil
+	}
+	v := 0
+	if v6only {
+		v = 1
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v)
+}
+
+// sockaddrToTCPAddr converts sa to *net.TCPAddr.
+func sockaddrToTCPAddr(sa syscall.Sockaddr) *net.TCPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+			addr.Zone = ifi.Name
+		}
+		return addr
+	}
+	return nil
+}
+
+// reservedPort is the socket that the master of ReusePort holds to reserve
+// the port. It's passed to the workers to tell the address to bind on.
+type reservedPort struct {
+	fd        int
+	addr      *net.TCPAddr
+	closeOnce sync.Once
+}
+
+func (r *reservedPort) Accept() (net.Conn, error) {
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: r.addr, Err: errors.New("miyabi: reserved port isn't listening")}
+}
+
+func (r *reservedPort) Close() error {
+	err := net.ErrClosed
+	r.closeOnce.Do(func() {
+		err = syscall.Close(r.fd)
+	})
+	return err
+}
+
+func (r *reservedPort) Addr() net.Addr {
+	return r.addr
+}
+
+// File returns a duplicate of the socket as net.TCPListener.File does.
+func (r *reservedPort) File() (*os.File, error) {
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Dup(r.fd)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	return os.NewFile(uintptr(fd), "reserved socket "+r.addr.String()), nil
+}
+
+// reusePortListener binds a new listener with SO_REUSEPORT on the address of
+// the socket reserved by the master, and closes file.
+func (srv *Server) reusePortListener(file *os.File) (listener, error) {
+	defer file.Close()
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	// The network is taken from the reserved socket rather than Network,
+	// so that the worker binds in the same way as the master.
+	var sa syscall.Sockaddr
+	var v6only int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if sa, serr = syscall.Getsockname(int(fd)); serr != nil {
+			serr = os.NewSyscallError("getsockname", serr)
+			return
+		}
+		if _, ok := sa.(*syscall.SockaddrInet6); ok {
+			v6only, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY)
+			serr = os.NewSyscallError("getsockopt", serr)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	addr := sockaddrToTCPAddr(sa)
+	if addr == nil {
+		return nil, errors.New("miyabi: reserved socket isn't TCP")
+	}
+	network := "tcp"
+	if _, ok := sa.(*syscall.SockaddrInet4); ok {
+		network = "tcp4"
+	} else if v6only != 0 {
+		network = "tcp6"
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	l, err := lc.Listen(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return tcpKeepAliveListener{l.(*net.TCPListener), srv.keepAlivePeriod(), srv.NoDelay}, nil
+}
@@ -2,18 +2,23 @@
 package miyabi
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -37,296 +42,2947 @@ var (
 	ServerState func(state State)
 
 	// FDEnvKey is the environment variable name of inherited file descriptor for graceful restart.
+	// It's a comma-separated list if the worker inherits more than one
+	// listener, e.g. by ListenAndServeActivate.
 	FDEnvKey = "MIYABI_FD"
 
 	errNotForked = errors.New("server isn't forked")
+
+	// ErrNotMaster is returned by Restart when the server isn't running as
+	// the master of ListenAndServe or ListenAndServeTLS.
+	ErrNotMaster = errors.New("miyabi: server isn't running as the master")
+
+	// ErrDraining is the cause of the cancellation of the request context
+	// of LongPollPaths when draining begins. See context.Cause.
+	ErrDraining = errors.New("miyabi: server is draining")
+
+	// ErrInvalidFD is returned by ListenAndServe and ListenAndServeTLS in
+	// the worker when the environment variable of FDEnvKey doesn't hold
+	// valid file descriptors of listening sockets, which means that the
+	// restart handoff has gone wrong or the variable has leaked into an
+	// unrelated process. The returned error wraps it with the variable and its value.
+	ErrInvalidFD = errors.New("miyabi: invalid inherited file descriptor")
+
+	// ErrCrashLoop is returned by ListenAndServe and ListenAndServeTLS in
+	// the master when the worker keeps exiting unexpectedly. See
+	// MaxRestarts.
+	ErrCrashLoop = errors.New("miyabi: worker keeps exiting unexpectedly")
+
+	readyOnce sync.Once
+)
+
+const (
+	// defaultKeepAlivePeriod is the default of Server.KeepAlivePeriod.
+	defaultKeepAlivePeriod = 3 * time.Minute
+
+	// defaultHealthCheckTimeout is the default of Server.HealthCheckTimeout.
+	defaultHealthCheckTimeout = 10 * time.Second
+
+	// defaultRestartRetryInterval is the default of
+	// Server.RestartRetryInterval.
+	defaultRestartRetryInterval = time.Minute
+
+	// defaultMaxRestarts, defaultRestartWindow and
+	// defaultMinRestartInterval are the defaults of Server.MaxRestarts,
+	// Server.RestartWindow and Server.MinRestartInterval.
+	defaultMaxRestarts        = 5
+	defaultRestartWindow      = time.Minute
+	defaultMinRestartInterval = time.Second
+
+	// defaultDrainHandshakeTimeout is the default of
+	// Server.DrainHandshakeTimeout.
+	defaultDrainHandshakeTimeout = 5 * time.Second
+
+	// rebindCheckInterval is the interval of the checks of Server.Rebind.
+	rebindCheckInterval = 5 * time.Second
+
+	// healthCheckInterval is the interval of retries of the health check.
+	healthCheckInterval = 100 * time.Millisecond
+
+	// readyFDEnvKey is the environment variable name of inherited file
+	// descriptor of the pipe to notify the master that the worker is ready.
+	readyFDEnvKey = "MIYABI_READY_FD"
+
+	// shutdownFDEnvKey is the environment variable name of inherited file
+	// descriptor of the pipe to notify the worker of the final shutdown.
+	shutdownFDEnvKey = "MIYABI_SHUTDOWN_FD"
+
+	// lbSafeHealthPath, lbSafePreShutdownDelay and lbSafeDrainTimeout are
+	// the defaults of HealthPath, PreShutdownDelay and DrainTimeout when
+	// LBSafeShutdown is enabled.
+	lbSafeHealthPath       = "/healthz"
+	lbSafePreShutdownDelay = 15 * time.Second
+	lbSafeDrainTimeout     = 30 * time.Second
+
+	// k8sPreShutdownDelay and k8sDrainTimeout are the defaults of
+	// PreShutdownDelay and DrainTimeout when KubernetesShutdown is enabled.
+	// They fit in the default terminationGracePeriodSeconds of 30 seconds.
+	k8sPreShutdownDelay = 5 * time.Second
+	k8sDrainTimeout     = 20 * time.Second
+
+	// generationEnvKey is the environment variable name of the generation
+	// of the worker. The first worker is generation 1 and it's incremented
+	// on each restart.
+	generationEnvKey = "MIYABI_GENERATION"
+
+	// extraFDsEnvKey is the environment variable name of the comma-separated
+	// file descriptors of Server.ExtraFiles.
+	extraFDsEnvKey = "MIYABI_EXTRA_FDS"
+
+	// reusePortEnvKey is the environment variable name that is set to "1"
+	// when the inherited socket is the port reserved for ReusePort.
+	reusePortEnvKey = "MIYABI_REUSEPORT"
+
+	// activatedEnvKey is the environment variable name that is set to "1"
+	// when the inherited sockets have been passed by systemd socket
+	// activation.
+	activatedEnvKey = "MIYABI_ACTIVATED"
+
+	// fdSocketPrefix is the prefix of the value of FDEnvKey that is
+	// followed by the file descriptor of the unix socket to receive the
+	// listeners from with UnixSocketFD.
+	fdSocketPrefix = "socket:"
+
+	// stateFDEnvKey is the environment variable name of inherited file
+	// descriptor of the pipe to pass RestartState to the master.
+	stateFDEnvKey = "MIYABI_STATE_FD"
+
+	// inheritedStateFDEnvKey is the environment variable name of inherited
+	// file descriptor of the pipe to receive the state of the old worker.
+	inheritedStateFDEnvKey = "MIYABI_INHERITED_STATE_FD"
 )
 
-// ListenAndServe acts like http.ListenAndServe but can be graceful shutdown
-// and restart.
-// If addr begin with "unix:", will listen on a Unix domain socket instead of
-// TCP.
-func ListenAndServe(addr string, handler http.Handler) error {
-	server := &Server{Addr: addr, Handler: handler}
-	return server.ListenAndServe()
+// ListenAndServe acts like http.ListenAndServe but can be graceful shutdown
+// and restart. The handler is typically nil, in which case
+// http.DefaultServeMux is used.
+// If addr begin with "unix:", will listen on a Unix domain socket instead of
+// TCP.
+func ListenAndServe(addr string, handler http.Handler) error {
+	server := &Server{Server: http.Server{Addr: addr, Handler: handler}}
+	return server.ListenAndServe()
+}
+
+// ListenAndServeTLS acts like http.ListenAndServeTLS but can be graceful
+// shutdown and restart. The handler is typically nil, in which case
+// http.DefaultServeMux is used.
+func ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
+	server := &Server{Server: http.Server{Addr: addr, Handler: handler}}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeContext is like ListenAndServe but the startup is bounded by
+// ctx. See Server.ListenAndServeContext.
+func ListenAndServeContext(ctx context.Context, addr string, handler http.Handler) error {
+	server := &Server{Server: http.Server{Addr: addr, Handler: handler}}
+	return server.ListenAndServeContext(ctx)
+}
+
+// ListenAndServeTLSContext is like ListenAndServeTLS but the startup is
+// bounded by ctx. See Server.ListenAndServeContext.
+func ListenAndServeTLSContext(ctx context.Context, addr, certFile, keyFile string, handler http.Handler) error {
+	server := &Server{Server: http.Server{Addr: addr, Handler: handler}}
+	return server.ListenAndServeTLSContext(ctx, certFile, keyFile)
+}
+
+// Server is similar to http.Server.
+// However, ListenAndServe, ListenAndServeTLS and Serve can be graceful
+// shutdown and restart.
+//
+// Server embeds http.Server, so its fields such as ReadTimeout and
+// MaxHeaderBytes are configured directly on Server, and HTTPServer returns
+// the embedded http.Server. Server used to be defined as http.Server, so
+// the composite literals written for the older versions need to move those
+// fields into the embedded one, e.g. &Server{Server: http.Server{Addr: addr}}.
+//
+// Serve installs its hooks into Handler, ConnContext and ConnState of the
+// embedded http.Server to track the connections. BaseContext is left as it
+// is, and the user's Handler, ConnContext and ConnState are called from the
+// hooks, so the contexts derived from BaseContext and ConnContext reach the
+// handlers and ConnState sees every state transition as usual.
+//
+// While draining, the keep-alive connections that are idle when it begins
+// are closed immediately, so that the clients reconnect elsewhere without
+// waiting for the active ones. The others are closed as soon as they become
+// idle, after the HTTP/1.1 pipelined requests that have already been
+// received on them are served. Keep-alive isn't disabled on shutdown, so
+// HTTP/1.0 clients get the same responses as usual, and their connections
+// without keep-alive are drained until they are closed after the response.
+//
+// Addr is fixed at the first bind by the master process. Workers forked by
+// graceful restart inherit the listening socket as it is, so changing Addr
+// afterwards is ignored and only reported to Logger as a warning.
+type Server struct {
+	http.Server
+
+	// DrainTimeout specifies the maximum duration to wait for active
+	// connections to finish after the listener is closed. When it elapses,
+	// the remaining connections are closed forcibly unless DrainDecision
+	// lets them finish.
+	// A zero value waits without limit.
+	DrainTimeout time.Duration
+
+	// DrainTimeoutPerConn specifies the duration added to DrainTimeout for
+	// each connection that is tracked when draining begins, so that a busy
+	// server gets more time to drain than an idle one. It's ignored if
+	// DrainTimeout is zero.
+	DrainTimeoutPerConn time.Duration
+
+	// DrainMaxTimeout specifies the upper limit of the drain timeout
+	// extended by DrainTimeoutPerConn. A zero value means no limit.
+	DrainMaxTimeout time.Duration
+
+	// DrainDecision specifies the optional callback function that is called
+	// at the drain deadline for each connection that is still serving a
+	// request. If it returns true, the request is allowed to finish until
+	// DrainHardTimeout. Otherwise the connection is closed immediately.
+	// If nil, all remaining connections are closed at the deadline.
+	DrainDecision func(r *http.Request) bool
+
+	// DrainHardTimeout specifies the maximum duration, measured from the
+	// start of draining, to wait for the requests that DrainDecision lets
+	// finish. A zero value waits without limit.
+	DrainHardTimeout time.Duration
+
+	// DrainIdleTimeout specifies the duration after which the connections
+	// that haven't sent a request yet, i.e. in http.StateNew, are closed
+	// while draining. The idle keep-alive connections don't wait for it
+	// since they are closed as soon as draining begins. It's meant to be
+	// shorter than IdleTimeout to speed up draining, and doesn't affect the
+	// normal operation. If set, draining also waits for the new connections
+	// to be closed. A zero value leaves them to http.Server.
+	DrainIdleTimeout time.Duration
+
+	// DrainHandshakeTimeout specifies the maximum duration to wait for the
+	// TLS connections that haven't sent a request when draining begins,
+	// which includes the connections in the middle of the handshake.
+	// Draining waits for them to complete the handshake and the request,
+	// and they are aborted if they don't send a request within the
+	// duration. If zero, 5 seconds is used.
+	DrainHandshakeTimeout time.Duration
+
+	// LongPollPaths specifies the patterns of the paths of long-polling
+	// endpoints, in the syntax of path.Match. The contexts of the requests
+	// to them are canceled with ErrDraining as soon as draining begins, so
+	// that the handlers can return immediately instead of holding the
+	// draining until the timeout.
+	LongPollPaths []string
+
+	// MaxConnections specifies the maximum number of the connections that
+	// are served at the same time. When it's reached, Accept is paused until
+	// a connection is closed, so that the excess connections wait in the
+	// backlog of the listener. It doesn't prevent draining from closing the
+	// listener. With ProxyProtocol, the connections are counted once their
+	// header has been read, and the ones whose header is being read don't
+	// wait in the backlog. A zero value means no limit.
+	MaxConnections int
+
+	// DrainReject503 makes the requests that arrive on the existing
+	// connections after draining begins, e.g. the pipelined ones, be
+	// answered with 503 Service Unavailable and Connection: close instead
+	// of being served. The requests in flight are finished as usual.
+	DrainReject503 bool
+
+	// OnDrain is called with the number of the remaining connections when
+	// draining begins and each time a connection is closed while draining,
+	// so that the progress can be logged. It's called until the count
+	// reaches zero unless the connections are closed forcibly. It's called
+	// without holding any lock, so it may call Stats.
+	OnDrain func(remaining int)
+
+	// OnShutdownStart and OnShutdownComplete specify the optional callback
+	// functions that are called in the serving process, i.e. the worker of
+	// ListenAndServe and ListenAndServeTLS, unlike StateShutdown that is
+	// notified in the master. OnShutdownStart is called once at the very
+	// beginning of shutdown, before PreShutdownDelay and before the listener
+	// is closed, e.g. to deregister the server from service discovery.
+	// OnShutdownComplete is called after the connections are drained and
+	// before Serve returns, e.g. to flush buffers. They are called on the
+	// graceful restart in the old worker as well. A panic in them is logged
+	// and doesn't stop the shutdown.
+	OnShutdownStart    func()
+	OnShutdownComplete func()
+
+	// HealthPath specifies the optional path of the health check endpoint
+	// for load balancers. Requests to the path are answered by the server
+	// itself with 200 OK, or with 503 Service Unavailable once shutdown
+	// begins, without calling Handler. Combine it with PreShutdownDelay to
+	// keep serving until load balancers or readiness probes notice it.
+	HealthPath string
+
+	// PreShutdownDelay specifies the duration to keep serving after
+	// shutdown begins and before the listener is closed, in order to give
+	// load balancers time to notice the failing HealthPath and deregister
+	// the server. It's applied on the final shutdown only, not on the
+	// graceful restarts and ActionForceShutdown.
+	PreShutdownDelay time.Duration
+
+	// PostListenCloseDelay specifies the duration to keep serving the
+	// existing connections as usual after the listener is closed and before
+	// draining begins, for load balancers that keep routing to the server
+	// for a while after it stops accepting. Unlike PreShutdownDelay, the new
+	// connections are refused during it. DrainTimeout starts after it. It's
+	// applied on the final shutdown only, in the same way as
+	// PreShutdownDelay.
+	PostListenCloseDelay time.Duration
+
+	// LBSafeShutdown enables the shutdown sequence for the servers behind a
+	// connection-draining load balancer such as AWS ALB or GCP load
+	// balancers:
+	//
+	//  1. HealthPath starts to respond with 503 Service Unavailable.
+	//  2. The server keeps serving for PreShutdownDelay (15 seconds by
+	//     default) while the load balancer deregisters it.
+	//  3. The listener is closed and the in-flight requests are drained.
+	//  4. The remaining connections are closed forcibly at DrainTimeout
+	//     (30 seconds by default).
+	//
+	// HealthPath is "/healthz" by default. Each of them is used as it is
+	// if set, so that the individual pieces can be overridden.
+	LBSafeShutdown bool
+
+	// KubernetesShutdown enables the shutdown sequence for the servers in
+	// Kubernetes pods, which avoids the 502 errors caused by the race
+	// between SIGTERM and the removal of the pod from the endpoints:
+	//
+	//  1. On SIGTERM, HealthPath starts to respond with 503 Service
+	//     Unavailable to fail the readiness probe, and the responses are
+	//     sent with "Connection: close" so that the keep-alive clients
+	//     reconnect to the other pods.
+	//  2. The server keeps serving for PreShutdownDelay (5 seconds by
+	//     default) while the endpoints controller removes the pod, and
+	//     kube-proxy and the ingress controllers stop sending new
+	//     connections to it.
+	//  3. The listener is closed and the in-flight requests are drained.
+	//  4. The remaining connections are closed forcibly at DrainTimeout
+	//     (20 seconds by default).
+	//
+	// terminationGracePeriodSeconds of the pod must be longer than the sum
+	// of the duration of the preStop hook, PreShutdownDelay and
+	// DrainTimeout, otherwise the kubelet kills the server while it's
+	// draining. The defaults fit in the default terminationGracePeriodSeconds
+	// of 30 seconds. If the preStop hook already sleeps for the endpoints
+	// removal, set PreShutdownDelay to a negative value to skip the delay.
+	//
+	// HealthPath is "/healthz" by default. Each of them is used as it is
+	// if set. LBSafeShutdown takes precedence over it.
+	KubernetesShutdown bool
+
+	// MinReadRate specifies the minimum rate in bytes per second to
+	// receive a request header. If a connection sends a request header
+	// slower than this after a grace period of one second, it's closed and
+	// logged in order to protect the server from slowloris-style attacks.
+	// Connections that send nothing are limited by ReadHeaderTimeout and
+	// IdleTimeout instead. For TLS served by ListenAndServeTLS and ServeTLS,
+	// the rate is measured on the encrypted bytes including the handshake,
+	// while the listener wrapped by tls.NewListener by the program isn't
+	// limited.
+	// A zero value disables the limit.
+	MinReadRate int64
+
+	// AcceptBackoff specifies the strategy to retry Accept on the temporary
+	// errors. If nil, the delay starts at 5 milliseconds and doubles up to
+	// 1 second, which is the same as http.Server.
+	AcceptBackoff AcceptBackoff
+
+	// MasterUser specifies the user name or uid that the master process
+	// switches to after binding the listener. Since the workers are forked
+	// by the master, they also run as this user. The primary group of the
+	// user is taken unless MasterGroup is set, and the supplementary groups
+	// are dropped. PidFile and ShutdownMarkerFile are written after the
+	// switch, so their directories must be writable by the user.
+	// If empty, the master keeps its credentials.
+	MasterUser string
+
+	// MasterGroup specifies the group name or gid that the master process
+	// switches to after binding the listener.
+	// If empty, the primary group of MasterUser is used, which must be
+	// known if MasterUser is a uid.
+	MasterGroup string
+
+	// BeforeServe specifies the optional callback function that is called
+	// in Serve with the listener right before accepting connections.
+	// If it returns an error, Serve closes the listener and returns the
+	// error without accepting any connection.
+	// Unlike StateStart, it's called in any process that serves requests.
+	BeforeServe func(l net.Listener) error
+
+	// ListenerCreated specifies the optional callback function that is
+	// called with the listener right after ListenAndServe and
+	// ListenAndServeTLS bind it in the master, including when it's rebound,
+	// and right after they inherit it in the worker, e.g. to find the port
+	// bound for ":0". The listener must not be accepted on or closed by it.
+	// With ReusePort, the master passes the socket that holds the port
+	// without listening.
+	ListenerCreated func(l net.Listener)
+
+	// WaitForDependencies specifies the optional callback function that is
+	// called in the master before forking the first worker, in order to
+	// wait for the dependencies such as databases to become available.
+	// If it returns an error, ListenAndServe and ListenAndServeTLS return
+	// the error without starting a worker. The context expires after
+	// DependenciesTimeout.
+	WaitForDependencies func(ctx context.Context) error
+
+	// DependenciesTimeout specifies the maximum duration of
+	// WaitForDependencies. A zero value waits without limit.
+	DependenciesTimeout time.Duration
+
+	// ShutdownMarkerFile specifies the optional path of the file that the
+	// master creates, or touches if it exists, when the shutdown has
+	// completed, including when the draining has been cut off by the
+	// timeouts. It's removed when the master starts, so that external tools
+	// can wait for it to appear.
+	ShutdownMarkerFile string
+
+	// PidFile specifies the optional path of the file that the master
+	// writes its PID to when it starts, so that the operators can send the
+	// signals to it. The PID doesn't change across graceful restarts. The
+	// file is removed when the master returns. A file left by the previous
+	// run is replaced unless the process in it is still running.
+	PidFile string
+
+	// HealthCheckURL specifies the optional URL that the master probes after
+	// a graceful restart to verify that the new worker is healthy. The
+	// worker is considered healthy if the URL responds with 2xx status code
+	// within HealthCheckTimeout. Otherwise StateRestartUnhealthy is fired
+	// and an error is logged.
+	HealthCheckURL string
+
+	// HealthCheckTimeout specifies the timeout for the health check.
+	// If zero, 10 seconds is used.
+	HealthCheckTimeout time.Duration
+
+	// ShutdownSignal and RestartSignal specify the signals for graceful
+	// shutdown and restart of this server. If nil, the package-level
+	// ShutdownSignal and RestartSignal are used respectively.
+	ShutdownSignal os.Signal
+	RestartSignal  os.Signal
+
+	// ShutdownSignals and RestartSignals specify the additional signals for
+	// graceful shutdown and restart of this server, in addition to
+	// ShutdownSignal and RestartSignal. They are ignored if Signals is set.
+	ShutdownSignals []os.Signal
+	RestartSignals  []os.Signal
+
+	// Timeout specifies the timeout for terminate of the old process of
+	// this server. If zero, the package-level Timeout is used.
+	Timeout time.Duration
+
+	// EscalationSignals specifies the optional signals to send to the old
+	// worker that is being stopped, before it's killed at Timeout. Each
+	// Signal is sent when the worker hasn't exited for After since the
+	// master started to wait for it, e.g. syscall.SIGQUIT to make a stuck
+	// Go program dump the goroutines. The steps after Timeout are never
+	// taken.
+	EscalationSignals []Escalation
+
+	// KeepAlivePeriod specifies the TCP keep-alive period of the
+	// connections accepted by ListenAndServe and ListenAndServeTLS.
+	// If zero, 3 minutes is used. If negative, TCP keep-alive is disabled.
+	KeepAlivePeriod time.Duration
+
+	// NoDelay specifies whether to set TCP_NODELAY explicitly on the
+	// connections accepted by ListenAndServe and ListenAndServeTLS to
+	// disable Nagle's algorithm. Note that the net package already sets it
+	// by default as seen in net/http, so false keeps that default rather
+	// than enabling Nagle's algorithm.
+	NoDelay bool
+
+	// Network specifies the network of Addr for ListenAndServe and
+	// ListenAndServeTLS, which is "tcp", "tcp4", "tcp6" or "unix". If empty,
+	// "tcp" is used, which listens on both IPv4 and IPv6 if the system
+	// supports it. Use "tcp4" or "tcp6" to restrict the listener to either
+	// of them. An Addr prefixed with "unix:" is a Unix domain socket
+	// regardless of Network.
+	Network string
+
+	// ReusePort specifies whether each worker of ListenAndServe and
+	// ListenAndServeTLS binds its own TCP socket with SO_REUSEPORT instead
+	// of sharing the socket of the master. The master binds the port without
+	// listening to hold it, and the old and the new workers listen on it
+	// together during a graceful restart. On Linux, the kernel balances the
+	// connections between the listening sockets, while on the BSDs the last
+	// bound one receives them. Note that the connections that are queued to
+	// the socket of the old worker but not accepted yet are reset when it's
+	// closed. It's supported on Linux, macOS and the BSDs, and ignored on
+	// Windows and for Unix domain sockets. On the other platforms, listening
+	// fails with an error if it's set.
+	ReusePort bool
+
+	// DisableHTTP2 specifies whether to disable HTTP/2 of ListenAndServeTLS.
+	// By default, "h2" is negotiated by ALPN unless TLSConfig.NextProtos is
+	// set, as net/http does. The HTTP/2 connections are drained in the same
+	// way as HTTP/1.x; the in-flight streams are waited for, and GOAWAY is
+	// sent with their responses.
+	DisableHTTP2 bool
+
+	// ProxyProtocol specifies whether the connections begin with the PROXY
+	// protocol v1 or v2 header sent by the load balancer in front of the
+	// server, such as HAProxy and AWS NLB. If true, RemoteAddr of the
+	// connections and http.Request returns the address of the client in the
+	// header, and the connections without the valid header are closed. For
+	// TLS, it takes effect in ListenAndServeTLS but not in Serve with a TLS
+	// listener, since the header precedes the TLS handshake.
+	ProxyProtocol bool
+
+	// StateChanged specifies the optional callback function that is called
+	// when this server changes state, which is fired in the master except
+	// StateReady. If set, it's called instead of the package-level
+	// ServerState, so that the servers in the same process can tell their
+	// own state changes apart. See the State type and associated constants
+	// for details.
+	StateChanged func(state State)
+
+	// Signals specifies the actions that the server takes when it receives
+	// the signals. If nil, syscall.SIGINT and ShutdownSignal shut down the
+	// server and RestartSignal restarts it. See also IgnoreSIGINT.
+	//
+	// Note that a worker always shuts down on ShutdownSignal because the
+	// master uses it to stop the old worker, and a worker ignores
+	// ActionRestart and ActionRebind since they are performed by the
+	// master.
+	Signals map[os.Signal]Action
+
+	// IgnoreSIGINT makes the server leave syscall.SIGINT (Ctrl+C) to the
+	// program instead of shutting down on it when Signals is nil, e.g. for
+	// an interactive prompt. The server doesn't register for SIGINT unless
+	// it's ShutdownSignal or RestartSignal.
+	IgnoreSIGINT bool
+
+	// ControlFIFO specifies the optional path of the named pipe (FIFO) to
+	// control the server by writing the commands in addition to the
+	// signals. The commands are "shutdown", "restart", "force-shutdown"
+	// and "rebind" per line, which take ActionShutdown, ActionRestart,
+	// ActionForceShutdown and ActionRebind respectively. The FIFO is
+	// created by the master, or by Serve when it's called directly, and
+	// removed on shutdown. It's not supported on Windows.
+	ControlFIFO string
+
+	// ShutdownChan specifies the optional channel that triggers graceful
+	// shutdown when a value is sent on it or it's closed, in the same way
+	// as ShutdownSignal, e.g. to tie the server to the lifecycle of the
+	// application that is managed by channels. It's received by the
+	// master, or by Serve when it's called directly, and ignored in the
+	// workers, which are shut down by the master. Whichever of it and the
+	// signals comes first takes effect.
+	ShutdownChan <-chan struct{}
+
+	// Rebind enables the master of ListenAndServe and ListenAndServeTLS to
+	// check periodically whether the address of the listener is still
+	// available, and to take ActionRebind if it isn't; that is, the bound
+	// IP address has been removed from the network interfaces, Addr has
+	// come to resolve to another IP address, or the Unix domain socket file
+	// has been removed.
+	//
+	// Rebinding has the following constraints:
+	//   - Accept doesn't report the removal of the address on most
+	//     platforms, so it's detected by polling the network interfaces
+	//     every 5 seconds rather than by the errors of Accept.
+	//   - The new listener is opened while the old worker is still serving
+	//     on the old one, so rebinding to the address that is still bound
+	//     fails. The failure is logged and the current listener is kept.
+	//   - The connections accepted on the old listener are drained by the
+	//     old worker as on graceful restart.
+	//   - A listener on the unspecified address such as ":8080" is never
+	//     checked since it doesn't need rebinding.
+	//   - It isn't supported on Windows, where there is no master.
+	Rebind bool
+
+	// ReadyTimeout specifies the timeout for a forked worker to become
+	// ready to serve. A worker is ready when it starts accepting
+	// connections in Serve. If a new worker doesn't become ready on
+	// graceful restart, it's killed and the old worker keeps running.
+	// If zero, Timeout is used.
+	ReadyTimeout time.Duration
+
+	// OnPromote specifies the optional callback function that is called
+	// on graceful restart when the new worker has become ready, before the
+	// old worker is stopped.
+	OnPromote func(oldPID, newPID int)
+
+	// OnForceKill specifies the optional callback function that is called
+	// in the master when a worker didn't exit within Timeout on graceful
+	// restart or shutdown and has been killed, which means that the
+	// draining has failed. It isn't called if the worker has exited by
+	// itself just before the timeout.
+	OnForceKill func(pid int)
+
+	// CanRestartNow specifies the optional function that reports whether
+	// a graceful restart is allowed now, e.g. within a maintenance window.
+	// If it returns false when RestartSignal is received, the restart is
+	// deferred and CanRestartNow is consulted again every
+	// RestartRetryInterval until it returns true. Like BlockRestarts, it
+	// only has effect in the master.
+	CanRestartNow func() bool
+
+	// RestartRetryInterval specifies the interval to consult CanRestartNow
+	// for a deferred restart. If zero, one minute is used.
+	RestartRetryInterval time.Duration
+
+	// MaxRestarts and RestartWindow limit the respawns of the worker that
+	// exits unexpectedly, e.g. by a panic, in the master of ListenAndServe
+	// and ListenAndServeTLS. The master starts a new worker in its place,
+	// but if the workers exit more than MaxRestarts times within
+	// RestartWindow, it gives up and returns ErrCrashLoop instead of
+	// spinning. They are 5 and one minute by default. A negative
+	// MaxRestarts disables respawning, so the master returns ErrCrashLoop
+	// as soon as the worker exits.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// MinRestartInterval specifies the minimum interval between the starts
+	// of the workers respawned after unexpected exits, so that a worker
+	// that crashes on startup doesn't hammer the system. If zero, one second
+	// is used.
+	MinRestartInterval time.Duration
+
+	// RestartState specifies the optional function that is called in the
+	// worker when it's about to exit after draining. The returned state is
+	// passed to the next worker on graceful restart, which can get it by
+	// InheritedState. It's meant for a small state that must not be reset
+	// across restarts, such as a generation counter or a sequence number.
+	RestartState func() []byte
+
+	// ProcessTitle specifies whether to set the process titles of the
+	// master and the workers to distinguish them in process listings such
+	// as ps and top. The titles are "<name> master" and "<name> w<N>",
+	// where <name> is the program name and <N> is the generation of the
+	// worker which is incremented on each restart.
+	// It's supported only on Linux, where the title is set to
+	// /proc/self/comm and the program name is truncated to fit in its
+	// limit of 15 bytes.
+	ProcessTitle bool
+
+	// LogRuntimeStats specifies whether to log the number of goroutines and
+	// the memory statistics at each state transition and when Serve starts
+	// and returns, in order to spot leaks across restarts and shutdowns.
+	// It's disabled by default because it stops the world to read the
+	// memory statistics.
+	LogRuntimeStats bool
+
+	// FDEnvKey specifies the environment variable name of the file
+	// descriptor inherited by the workers of this server, so that the
+	// servers in the same program don't take each other's listener. If
+	// empty, the package-level FDEnvKey is used.
+	FDEnvKey string
+
+	// ListenerName specifies the optional label of the listening socket
+	// inherited by the workers, which appears in the error messages about
+	// it. If empty, Addr is used.
+	ListenerName string
+
+	// ExecutablePath specifies the path of the program to start the
+	// workers from. If empty, the path of the executable of the current
+	// process reported by os.Executable is used, which refers to the binary
+	// that has replaced it on disk, but has symbolic links resolved on some
+	// systems. Set it to the path of the symbolic link to restart on the new
+	// binary swapped in by deploys.
+	ExecutablePath string
+
+	// WorkingDir specifies the working directory of the workers. If empty,
+	// the current working directory of the master is used, or the
+	// directory of the executable if it can't be determined, e.g. because
+	// it has been removed.
+	WorkingDir string
+
+	// FDTransport specifies how the master passes the listeners to the
+	// workers. See EnvFD and UnixSocketFD. The workers receive them in
+	// either way regardless of their own FDTransport.
+	FDTransport FDTransport
+
+	// ExtraFiles specifies the additional open files inherited by the
+	// workers, such as the sockets of the application that must survive
+	// graceful restarts. As exec.Cmd.ExtraFiles, ExtraFiles[i] becomes the
+	// file descriptor 8+i in the workers since 3 to 7 are used by miyabi.
+	// The numbers are also listed in the MIYABI_EXTRA_FDS environment
+	// variable, and the workers can get the files by the ExtraFiles
+	// function.
+	ExtraFiles []*os.File
+
+	// ChildArgs specifies the command line arguments of the workers,
+	// excluding the program name, e.g. to add a flag that tells the
+	// workers forked by graceful restart. If nil, the arguments of the
+	// master are used.
+	ChildArgs []string
+
+	// ChildEnv specifies the environment of the workers in the form
+	// "key=value", e.g. to scrub or rotate the secrets across graceful
+	// restarts. If nil, the environment of the master is used. The
+	// variables to pass the listener and the pipes are added to it.
+	ChildEnv []string
+
+	// KillChildWithParent specifies whether the workers are killed when
+	// the master dies, even by SIGKILL, so that they aren't left running
+	// orphaned after the master crashes. It sets the parent-death signal
+	// with prctl(PR_SET_PDEATHSIG) in the workers, which is supported only
+	// on Linux and ignored on the other systems. Note that the signal is
+	// sent when the OS thread of the master that forked the worker exits.
+	// The Go runtime rarely terminates its threads, but it does when a
+	// goroutine exits while locked by runtime.LockOSThread.
+	KillChildWithParent bool
+
+	// Logger specifies an optional logger for the lifecycle events and
+	// warnings of the server. If nil, ErrorLog is used instead. If both are
+	// nil, nothing is logged.
+	Logger Logger
+
+	initOnce    sync.Once
+	handler     http.Handler
+	connContext func(ctx context.Context, c net.Conn) context.Context
+	connState   func(c net.Conn, state http.ConnState)
+	connSlots   chan struct{}
+	mu          sync.Mutex
+	conns       map[net.Conn]*trackedConn
+	connChanged chan struct{}
+
+	// busy is the number of the tracked connections that are busy. See
+	// trackedConn.busy. It's changed only on the state transitions of the
+	// tracked connections under mu, so it never goes negative. A WaitGroup
+	// isn't used because connections may become busy while being waited.
+	busy int
+
+	// notBusy is closed when busy becomes zero.
+	notBusy chan struct{}
+
+	// listener is the listener that Serve is serving on.
+	listener net.Listener
+
+	// drainCtx is canceled with ErrDraining when draining begins.
+	drainCtx    context.Context
+	cancelDrain context.CancelCauseFunc
+
+	// ready and done are closed when Serve begins serving and returns
+	// respectively.
+	ready chan struct{}
+	done  chan struct{}
+
+	// serveErr is the error returned by the last Serve. See Wait.
+	serveErr error
+
+	// inFlight and served are the numbers of the requests in flight and
+	// the requests that have been served. See Stats. The types of
+	// sync/atomic are used for the alignment on 32-bit platforms.
+	inFlight atomic.Int64
+	served   atomic.Uint64
+
+	// truncated is the number of the responses that have been cut off by
+	// closing the connections forcibly. See Stats.
+	truncated atomic.Uint64
+
+	// activeConns is the number of the connections in StateActive. See
+	// NumActiveConns.
+	activeConns atomic.Int64
+
+	// workerPID is the pid of the current worker in the master. See
+	// WorkerPid.
+	workerPID atomic.Int64
+
+	// tlsCert is the certificate loaded from the files by ListenAndServeTLS,
+	// which is swapped by ReloadTLS.
+	tlsCert atomic.Pointer[tls.Certificate]
+
+	// shuttingDown is set to non-zero when shutdown begins, which is
+	// before PreShutdownDelay.
+	shuttingDown int32
+
+	// draining is set to non-zero when graceful shutdown begins.
+	draining int32
+
+	// forceShutdown is set to non-zero by ActionForceShutdown.
+	forceShutdown int32
+
+	// drainDeferred is set to non-zero when shutdown closes the listener
+	// without starting draining, which is started by Serve after
+	// PostListenCloseDelay.
+	drainDeferred int32
+
+	// generation is the generation of the latest worker forked by the
+	// master.
+	generation int
+
+	// listen opens a new listener of the master on Addr for ActionRebind.
+	listen func() (listener, error)
+
+	// masterActions receives the actions requested by Shutdown and Restart
+	// while the master is supervising, and supervised is closed when it
+	// ends.
+	masterActions chan Action
+	supervised    chan struct{}
+
+	// masterAddr is the address of the listener of the master while it's
+	// supervising.
+	masterAddr net.Addr
+
+	// extraListeners are the listeners that the master passes to the
+	// workers in addition to the main one, e.g. the rest of the sockets
+	// activated by systemd.
+	extraListeners []listener
+
+	// activated is true while the master is supervising the sockets passed
+	// by systemd socket activation.
+	activated bool
+
+	// closers are the closers registered by RegisterCloser.
+	closers []io.Closer
+
+	restartMu      sync.Mutex
+	restartBlocks  int
+	restartPending bool
+	unblocked      chan struct{}
+}
+
+// trackedConn represents a connection tracked by Serve.
+type trackedConn struct {
+	// state is the current state of the connection.
+	state http.ConnState
+
+	// since is the time when the connection changed into state.
+	since time.Time
+
+	// req and resp are the request that is being served on the connection
+	// and its response.
+	req  *http.Request
+	resp *responseWriter
+
+	// handshaking is true while draining waits for the TLS connection
+	// that hasn't sent a request yet, which may be in the middle of the
+	// handshake.
+	handshaking bool
+
+	// goingAway is true while draining waits for the HTTP/2 connection
+	// that has been told to go away to close by itself.
+	goingAway bool
+}
+
+// busy reports whether draining should wait for the connection.
+func (tc *trackedConn) busy() bool {
+	return tc.state == http.StateActive || tc.handshaking || tc.goingAway
+}
+
+// connContextKey is the context key of the net.Conn that the request
+// arrived on.
+type connContextKey struct{}
+
+// ListenAndServe acts like http.Server.ListenAndServe but can be graceful
+// shutdown and restart. If srv.Addr begin with "unix:", will listen on a Unix
+// domain socket instead of TCP.
+//
+// On Windows, there is no master since a listening socket can't be passed
+// to a forked process through a file descriptor, so the current process
+// serves by itself and can't be restarted gracefully. It's still shut down
+// gracefully by Shutdown, Ctrl+C and Ctrl+Break (os.Interrupt), and by
+// closing the console, logging off and shutting down the system, which
+// os/signal delivers as syscall.SIGTERM, the default ShutdownSignal.
+func (srv *Server) ListenAndServe() error {
+	return srv.ListenAndServeContext(context.Background())
+}
+
+// ListenAndServeContext is like ListenAndServe but aborts the startup with
+// ctx.Err() if ctx expires before the first worker becomes ready. The startup
+// includes binding the listener, WaitForDependencies and forking the first
+// worker. ctx doesn't affect the server after the startup; use ShutdownSignal
+// or Shutdown to shut it down.
+func (srv *Server) ListenAndServeContext(ctx context.Context) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	if runtime.GOOS == "windows" {
+		// See ListenAndServe for the behavior on Windows.
+		l, err := srv.listenAddr(addr)
+		if err != nil {
+			return err
+		}
+		srv.listenerCreated(l)
+		if err := ctx.Err(); err != nil {
+			l.Close()
+			return err
+		}
+		return srv.Serve(l)
+	}
+	if srv.IsMaster() {
+		srv.listen = func() (listener, error) {
+			return srv.listenAddr(addr)
+		}
+		l, err := srv.listen()
+		if err != nil {
+			return err
+		}
+		srv.listenerCreated(l)
+		return srv.supervise(ctx, l)
+	}
+	ln, err := srv.listenerFromFDEnv(addr)
+	if err != nil {
+		return err
+	}
+	srv.checkInheritedAddr(addr, ln.Addr())
+	srv.listenerCreated(ln)
+	srv.setWorkerTitle()
+	return srv.Serve(ln)
+}
+
+// ListenAndServeTLS acts like http.Server.ListenAndServeTLS but can be
+// graceful shutdown and restart. TLSConfig is used as it is except for the
+// certificate loaded from certFile and keyFile, so the settings of mutual TLS
+// such as ClientAuth and ClientCAs take effect. Each worker builds its TLS
+// configuration by itself, so they survive graceful restarts.
+//
+// certFile and keyFile may be empty if TLSConfig has Certificates,
+// GetCertificate or GetConfigForClient, which select the certificate, e.g.
+// by SNI for multiple domains. Otherwise the certificate loaded from them is
+// the default, and the ones in TLSConfig.Certificates are presented to the
+// clients that request their names by SNI. The other settings of TLSConfig
+// such as MinVersion, CipherSuites and CurvePreferences are honored. If
+// TLSConfig.NextProtos is nil, the protocols of TLSNextProto are negotiated
+// by ALPN, or "h2" if TLSNextProto is nil, in addition to "http/1.1".
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	return srv.ListenAndServeTLSContext(context.Background(), certFile, keyFile)
+}
+
+// ListenAndServeTLSContext is like ListenAndServeTLS but the startup is
+// bounded by ctx as ListenAndServeContext.
+func (srv *Server) ListenAndServeTLSContext(ctx context.Context, certFile, keyFile string) error {
+	if runtime.GOOS == "windows" {
+		// See ListenAndServe for the behavior on Windows.
+		config, err := srv.tlsConfig(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		l, err := srv.listenAddr(srv.tlsAddr())
+		if err != nil {
+			return err
+		}
+		srv.listenerCreated(l)
+		if err := ctx.Err(); err != nil {
+			l.Close()
+			return err
+		}
+		return srv.Serve(srv.tlsListener(l, config))
+	}
+	if srv.IsMaster() {
+		srv.listen = func() (listener, error) {
+			return srv.listenTLS(certFile, keyFile)
+		}
+		l, err := srv.listen()
+		if err != nil {
+			return err
+		}
+		srv.listenerCreated(l)
+		return srv.supervise(ctx, l)
+	}
+	addr := srv.tlsAddr()
+	// The worker loads the certificate and TLSConfig by itself, so they
+	// survive graceful restarts as long as the program configures them in
+	// the same way.
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ln, err := srv.listenerFromFDEnv(addr)
+	if err != nil {
+		return err
+	}
+	srv.checkInheritedAddr(addr, ln.Addr())
+	srv.listenerCreated(ln)
+	srv.setWorkerTitle()
+	return srv.Serve(srv.tlsListener(ln, config))
+}
+
+// Serve acts like http.Server.Serve but can be graceful shutdown.
+// If you want to graceful restart, use ListenAndServe or ListenAndServeTLS instead.
+// If Handler is nil, http.DefaultServeMux is used behind the health check
+// and the draining, which are served by srv itself.
+func (srv *Server) Serve(l net.Listener) error {
+	return srv.ServeContext(context.Background(), l)
+}
+
+// ServeTLS is like Serve but serves HTTPS on l, e.g. a listener passed by
+// systemd socket activation or created by the program. The TLS
+// configuration is built from TLSConfig, certFile and keyFile in the same
+// way as ListenAndServeTLS, so ReloadTLS renews the certificate as well.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return srv.Serve(srv.tlsListener(l, config))
+}
+
+// ServeMulti is like Serve but serves on all of the listeners, e.g. both of
+// HTTP and HTTPS by passing a listener wrapped by tls.NewListener. The
+// listeners are closed and drained together on shutdown. BeforeServe and
+// BoundAddr see them as a single listener that has the address of the
+// first one.
+func (srv *Server) ServeMulti(listeners ...net.Listener) error {
+	switch len(listeners) {
+	case 0:
+		return errors.New("miyabi: no listener to serve")
+	case 1:
+		return srv.Serve(listeners[0])
+	}
+	proxied := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		proxied[i] = srv.proxyListener(l)
+	}
+	return srv.Serve(newMultiListener(proxied))
+}
+
+// ServeContext is like Serve but also shuts the server down gracefully when
+// ctx is done, in the same way as Shutdown. The listener is closed and the
+// active connections are drained within DrainTimeout, then ServeContext
+// returns nil. It's handy to tie the server to the root context of the
+// application.
+func (srv *Server) ServeContext(ctx context.Context, l net.Listener) (err error) {
+	srv.init()
+	ready, done := srv.beginServe(l)
+	defer func() {
+		srv.endServe(done, err)
+	}()
+	if srv.BeforeServe != nil {
+		if err := srv.BeforeServe(l); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	atomic.StoreInt32(&srv.shuttingDown, 0)
+	atomic.StoreInt32(&srv.draining, 0)
+	atomic.StoreInt32(&srv.forceShutdown, 0)
+	atomic.StoreInt32(&srv.drainDeferred, 0)
+	srv.logRuntimeStats("serve_start")
+	defer srv.logRuntimeStats("serve_done")
+	stopWaitSignals, err := srv.startWaitSignals(l)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	notifyReady()
+	close(ready)
+	srv.setState(StateReady)
+	stopShutdown := context.AfterFunc(ctx, func() {
+		srv.shutdown(l, true, false)
+	})
+	defer stopShutdown()
+	backoff := srv.AcceptBackoff
+	if backoff == nil {
+		backoff = &exponentialBackoff{}
+	}
+	err = srv.Server.Serve(&serverListener{Listener: srv.proxyListener(l), srv: srv, backoff: backoff})
+	if atomic.LoadInt32(&srv.drainDeferred) != 0 {
+		srv.logf("miyabi: waiting %v before draining", srv.PostListenCloseDelay)
+		time.Sleep(srv.PostListenCloseDelay)
+		srv.startDrain()
+	}
+	stopWaitSignals()
+	if atomic.LoadInt32(&srv.forceShutdown) != 0 {
+		srv.closeConns(nil)
+	} else {
+		srv.drain()
+	}
+	if atomic.LoadInt32(&srv.shuttingDown) != 0 {
+		srv.callHook("OnShutdownComplete", srv.OnShutdownComplete)
+	}
+	if srv.RestartState != nil {
+		writeRestartState(srv.RestartState())
+	}
+	if isListenerClosed(err) {
+		err = nil
+	}
+	if cerr := srv.closeClosers(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// isListenerClosed reports whether err is returned by Accept of the closed
+// listener.
+func isListenerClosed(err error) bool {
+	if err, ok := err.(*net.OpError); ok {
+		op := err.Op
+		if runtime.GOOS == "windows" && op == "AcceptEx" {
+			op = "accept"
+		}
+		return op == "accept" && err.Err.Error() == "use of closed network connection"
+	}
+	return false
+}
+
+// HTTPServer returns the underlying http.Server of srv. It shares the fields
+// with srv, so it can be passed to the functions that expect *http.Server
+// to configure srv.
+//
+// Note that Serve installs its hooks into Handler, ConnState and
+// ConnContext of the http.Server, so don't overwrite them through the
+// returned value while serving.
+func (srv *Server) HTTPServer() *http.Server {
+	return &srv.Server
+}
+
+// SetKeepAlivesEnabled is same as http.Server.SetKeepAlivesEnabled.
+func (srv *Server) SetKeepAlivesEnabled(v bool) {
+	srv.Server.SetKeepAlivesEnabled(v)
+}
+
+// init installs the hooks for connection tracking into srv.Server.
+func (srv *Server) init() {
+	srv.initOnce.Do(func() {
+		if srv.DisableHTTP2 && srv.TLSNextProto == nil {
+			// An empty map disables HTTP/2 of http.Server.
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		srv.conns = make(map[net.Conn]*trackedConn)
+		srv.connChanged = make(chan struct{}, 1)
+		srv.handler = srv.Handler
+		srv.Handler = http.HandlerFunc(srv.serveHTTP)
+		srv.connContext = srv.ConnContext
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			if srv.connContext != nil {
+				ctx = srv.connContext(ctx, c)
+			}
+			return context.WithValue(ctx, connContextKey{}, c)
+		}
+		if srv.MaxConnections > 0 {
+			srv.connSlots = make(chan struct{}, srv.MaxConnections)
+		}
+		srv.connState = srv.ConnState
+		srv.ConnState = func(c net.Conn, state http.ConnState) {
+			srv.trackConn(c, state)
+			if srv.connState != nil {
+				srv.connState(c, state)
+			}
+		}
+	})
+}
+
+// serveHTTP records the request on its connection while the user's handler
+// is serving it.
+func (srv *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.inFlight.Add(1)
+	defer func() {
+		srv.inFlight.Add(-1)
+		srv.served.Add(1)
+	}()
+	if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		rw := &responseWriter{ResponseWriter: w}
+		if r.ProtoMajor == 2 {
+			rw.onBegin = func(header http.Header) {
+				srv.goAway(c, header)
+			}
+		}
+		w = rw.wrap()
+		srv.setRequest(c, r, rw)
+		defer srv.setRequest(c, nil, nil)
+	}
+	if path := srv.healthPath(); path != "" && r.URL.Path == path {
+		srv.serveHealth(w)
+		return
+	}
+	if srv.DrainReject503 && atomic.LoadInt32(&srv.draining) != 0 {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if srv.KubernetesShutdown && atomic.LoadInt32(&srv.shuttingDown) != 0 {
+		w.Header().Set("Connection", "close")
+	}
+	if srv.isLongPoll(r.URL.Path) {
+		srv.mu.Lock()
+		drainCtx := srv.drainCtx
+		srv.mu.Unlock()
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		stop := context.AfterFunc(drainCtx, func() {
+			cancel(context.Cause(drainCtx))
+		})
+		defer stop()
+		r = r.WithContext(ctx)
+	}
+	handler := srv.handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// goAway makes the HTTP/2 connection c go away after the response that is
+// beginning with header if draining. The HTTP/2 server sends GOAWAY for
+// "Connection: close", and closes c by itself once the in-flight streams
+// have been flushed, so draining waits for it instead of closing c.
+func (srv *Server) goAway(c net.Conn, header http.Header) {
+	if atomic.LoadInt32(&srv.draining) == 0 {
+		return
+	}
+	header.Set("Connection", "close")
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if tc, exists := srv.conns[c]; exists {
+		busy := tc.busy()
+		tc.goingAway = true
+		srv.setBusy(busy, tc.busy())
+	}
+}
+
+// isLongPoll reports whether urlPath matches any of LongPollPaths.
+func (srv *Server) isLongPoll(urlPath string) bool {
+	for _, pattern := range srv.LongPollPaths {
+		if matched, _ := path.Match(pattern, urlPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) setRequest(c net.Conn, r *http.Request, w *responseWriter) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if tc, exists := srv.conns[c]; exists {
+		tc.req, tc.resp = r, w
+	}
+}
+
+func (srv *Server) trackConn(c net.Conn, state http.ConnState) {
+	remaining := -1
+	defer func() {
+		if remaining >= 0 && srv.OnDrain != nil {
+			srv.OnDrain(remaining)
+		}
+	}()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	tc, exists := srv.conns[c]
+	if !exists {
+		if state == http.StateClosed || state == http.StateHijacked {
+			return
+		}
+		tc = &trackedConn{state: http.StateNew}
+		srv.conns[c] = tc
+	}
+	busy := tc.busy()
+	if sc := serverConnOf(c); sc != nil {
+		sc.stateChanged(state)
+	}
+	if tc.state == http.StateActive {
+		srv.activeConns.Add(-1)
+	}
+	if state == http.StateActive {
+		srv.activeConns.Add(1)
+	}
+	tc.state = state
+	tc.handshaking = tc.handshaking && state == http.StateNew
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		tc.goingAway = false
+		delete(srv.conns, c)
+		srv.releaseConnSlot()
+		if atomic.LoadInt32(&srv.draining) != 0 {
+			remaining = len(srv.conns)
+		}
+	default:
+		tc.since = time.Now()
+		if atomic.LoadInt32(&srv.draining) != 0 && !tc.goingAway {
+			closeIfIdle(c, state)
+			srv.waitHandshake(c, tc)
+		}
+	}
+	srv.setBusy(busy, tc.busy())
+	select {
+	case srv.connChanged <- struct{}{}:
+	default:
+	}
+}
+
+// acquireConnSlot waits until the number of the connections falls below
+// MaxConnections and takes a slot for a new connection. It returns false if
+// draining begins in the meantime.
+func (srv *Server) acquireConnSlot() bool {
+	if srv.connSlots == nil {
+		return true
+	}
+	select {
+	case srv.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	srv.mu.Lock()
+	drainCtx := srv.drainCtx
+	srv.mu.Unlock()
+	select {
+	case srv.connSlots <- struct{}{}:
+		return true
+	case <-drainCtx.Done():
+		return false
+	}
+}
+
+// releaseConnSlot releases the slot taken by acquireConnSlot.
+func (srv *Server) releaseConnSlot() {
+	select {
+	case <-srv.connSlots:
+	default:
+	}
+}
+
+// startDrain makes the idle connections be closed once they have no
+// pipelined request to serve.
+func (srv *Server) startDrain() {
+	srv.mu.Lock()
+	defer func() {
+		remaining := len(srv.conns)
+		srv.mu.Unlock()
+		if srv.OnDrain != nil {
+			srv.OnDrain(remaining)
+		}
+	}()
+	atomic.StoreInt32(&srv.draining, 1)
+	if srv.cancelDrain != nil {
+		srv.cancelDrain(ErrDraining)
+	}
+	for c, tc := range srv.conns {
+		closeIfIdle(c, tc.state)
+		busy := tc.busy()
+		srv.waitHandshake(c, tc)
+		srv.setBusy(busy, tc.busy())
+	}
+}
+
+// waitHandshake makes draining wait for the TLS connection c if it hasn't
+// sent a request yet, so that the handshake in progress isn't dropped. c is
+// given DrainHandshakeTimeout to complete the handshake and send a request,
+// otherwise it's aborted by the deadline. mu must be held.
+func (srv *Server) waitHandshake(c net.Conn, tc *trackedConn) {
+	if _, ok := c.(*tls.Conn); !ok || tc.state != http.StateNew || tc.handshaking {
+		return
+	}
+	tc.handshaking = true
+	c.SetDeadline(time.Now().Add(srv.drainHandshakeTimeout()))
+}
+
+// drainHandshakeTimeout returns DrainHandshakeTimeout or its default.
+func (srv *Server) drainHandshakeTimeout() time.Duration {
+	if srv.DrainHandshakeTimeout > 0 {
+		return srv.DrainHandshakeTimeout
+	}
+	return defaultDrainHandshakeTimeout
+}
+
+// setBusy updates the number of the busy connections when a connection
+// changes from busy to is. mu must be held.
+func (srv *Server) setBusy(was, is bool) {
+	switch {
+	case !was && is:
+		srv.busy++
+	case was && !is:
+		srv.busy--
+		if srv.busy == 0 && srv.notBusy != nil {
+			close(srv.notBusy)
+			srv.notBusy = nil
+		}
+	}
+}
+
+// closeIfIdle closes the connection c if it's idle. If c is a serverConn,
+// or a TLS connection over it made by tlsListener, it's closed by
+// http.Server after serving the pipelined requests that have already been
+// received.
+func closeIfIdle(c net.Conn, state http.ConnState) {
+	sc := serverConnOf(c)
+	switch {
+	case sc != nil:
+		sc.expire(state == http.StateIdle)
+	case state == http.StateIdle:
+		c.Close()
+	}
+}
+
+// drain waits for the busy connections, which are the active connections and
+// the TLS connections waited by waitHandshake, to finish within DrainTimeout
+// and DrainHardTimeout. If DrainIdleTimeout is set, it also waits for the new
+// connections while closing the ones that exceed it.
+func (srv *Server) drain() {
+	done := srv.busyDone()
+	start := time.Now()
+	var deadline <-chan time.Time
+	if timeout := srv.drainTimeout(); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	if srv.DrainIdleTimeout > 0 {
+		if srv.waitIdleConns(deadline) {
+			return
+		}
+	} else {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+		}
+	}
+	if srv.closeConns(srv.DrainDecision) == 0 {
+		return
+	}
+	var hardTimeout <-chan time.Time
+	if srv.DrainHardTimeout > 0 {
+		timer := time.NewTimer(srv.DrainHardTimeout - time.Since(start))
+		defer timer.Stop()
+		hardTimeout = timer.C
+	}
+	select {
+	case <-done:
+	case <-hardTimeout:
+		srv.closeConns(nil)
+	}
+}
+
+// busyDone returns a channel that is closed when no tracked connection
+// is busy.
+func (srv *Server) busyDone() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.busy == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if srv.notBusy == nil {
+		srv.notBusy = make(chan struct{})
+	}
+	return srv.notBusy
+}
+
+// beginServe sets l as the listener being served and returns the channels
+// to be closed when it's ready and done.
+func (srv *Server) beginServe(l net.Listener) (ready, done chan struct{}) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.done != nil {
+		select {
+		case <-srv.done:
+			// Served before, so renew the channels.
+			srv.ready, srv.done = nil, nil
+		default:
+		}
+	}
+	srv.lifecycle()
+	srv.listener = l
+	srv.drainCtx, srv.cancelDrain = context.WithCancelCause(context.Background())
+	return srv.ready, srv.done
+}
+
+// endServe clears the listener, records err for Wait and closes done.
+func (srv *Server) endServe(done chan struct{}, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.listener = nil
+	srv.serveErr = err
+	close(done)
+}
+
+// lifecycle creates the ready and done channels if not yet. mu must be held.
+func (srv *Server) lifecycle() {
+	if srv.ready == nil {
+		srv.ready = make(chan struct{})
+		srv.done = make(chan struct{})
+	}
+}
+
+// BoundAddr returns the address of the listener that the server is serving
+// on, which tells the port chosen by the kernel when Addr has port 0. In the
+// master of ListenAndServe and ListenAndServeTLS, it returns the address of
+// the listener shared with the workers after StateStart. It returns nil if
+// the server isn't listening; use WaitReady or StateChanged to wait for it.
+// It's safe to call from any goroutine.
+func (srv *Server) BoundAddr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listener != nil {
+		return srv.listener.Addr()
+	}
+	return srv.masterAddr
+}
+
+// setMasterAddr sets the address returned by BoundAddr in the master.
+func (srv *Server) setMasterAddr(addr net.Addr) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.masterAddr = addr
+}
+
+// WorkerPid returns the pid of the current worker in the master of
+// ListenAndServe and ListenAndServeTLS. It's updated before StateStart and
+// StateRestart are fired, when the new worker has become ready, so it can be
+// called in StateChanged to tell the worker. It returns 0 in the workers and
+// if the master isn't supervising. It's safe to call from any goroutine.
+func (srv *Server) WorkerPid() int {
+	return int(srv.workerPID.Load())
+}
+
+// WaitReady waits until Serve begins serving, which is after BeforeServe
+// and the signal handlers are set up. It returns http.ErrServerClosed if
+// Serve returns before that, or the context's error if ctx expires first.
+//
+// WaitReady, Shutdown, Done and Wait allow to control the server without
+// signals, e.g. in tests.
+func (srv *Server) WaitReady(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.lifecycle()
+	ready, done := srv.ready, srv.done
+	srv.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-done:
+		return http.ErrServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown gracefully shuts down the server as if ShutdownSignal was
+// received, and waits for Serve to return. If ctx expires first, it
+// returns the context's error while the draining continues in Serve.
+// It does nothing and returns nil if Serve isn't running.
+//
+// In the master of ListenAndServe and ListenAndServeTLS, it shuts down the
+// worker and waits for ListenAndServe or ListenAndServeTLS to return
+// instead. It's safe to call from any goroutine.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	l, done := srv.listener, srv.done
+	actions, supervised := srv.masterActions, srv.supervised
+	srv.mu.Unlock()
+	if actions != nil {
+		select {
+		case actions <- ActionShutdown:
+		case <-supervised:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-supervised:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if l == nil {
+		return nil
+	}
+	go srv.shutdown(l, true, false)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Restart gracefully restarts the server as if RestartSignal was received.
+// The new worker inherits the listener in the same way, and StateRestart is
+// fired when it has replaced the old worker. The new worker is started from
+// the binary on disk at the time of the restart, so replacing the binary and
+// restarting upgrades the program in place. See ExecutablePath for the path.
+// If the binary has been removed, the restart fails and the old worker keeps
+// serving. It returns once the master
+// accepts the request, and the restart may be deferred by BlockRestarts and
+// CanRestartNow as well.
+//
+// Shutdown takes precedence over restart. If shutdown is requested while
+// the new worker is starting, the restart is canceled by killing the new
+// worker, and the restarts requested after shutdown are ignored.
+//
+// It's valid only in the master of ListenAndServe and ListenAndServeTLS
+// after StateStart, otherwise it returns ErrNotMaster. It's safe to call
+// from any goroutine.
+func (srv *Server) Restart() error {
+	srv.mu.Lock()
+	actions, supervised := srv.masterActions, srv.supervised
+	srv.mu.Unlock()
+	if actions == nil {
+		return ErrNotMaster
+	}
+	select {
+	case actions <- ActionRestart:
+		return nil
+	case <-supervised:
+		return ErrNotMaster
+	}
+}
+
+// Done returns a channel that is closed when Serve returns.
+func (srv *Server) Done() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.lifecycle()
+	return srv.done
+}
+
+// Wait waits until Serve returns, which is after the connections have been
+// drained, and returns the error returned by Serve. Like Done, it also waits
+// for Serve to be called if it isn't running yet. It's safe to call before
+// or after Shutdown, so that shutting down and waiting for it can be done
+// separately, e.g. to shut down several servers at once.
+func (srv *Server) Wait() error {
+	<-srv.Done()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.serveErr
+}
+
+// baseDrainTimeout returns DrainTimeout, or its default if LBSafeShutdown
+// or KubernetesShutdown is enabled.
+func (srv *Server) baseDrainTimeout() time.Duration {
+	if srv.DrainTimeout == 0 && srv.LBSafeShutdown {
+		return lbSafeDrainTimeout
+	}
+	if srv.DrainTimeout == 0 && srv.KubernetesShutdown {
+		return k8sDrainTimeout
+	}
+	return srv.DrainTimeout
+}
+
+// drainTimeout returns DrainTimeout extended by DrainTimeoutPerConn for each
+// tracked connection and limited to DrainMaxTimeout.
+func (srv *Server) drainTimeout() time.Duration {
+	base := srv.baseDrainTimeout()
+	if base <= 0 {
+		return 0
+	}
+	srv.mu.Lock()
+	n := len(srv.conns)
+	srv.mu.Unlock()
+	timeout := base + time.Duration(n)*srv.DrainTimeoutPerConn
+	if srv.DrainMaxTimeout > 0 && timeout > srv.DrainMaxTimeout {
+		timeout = srv.DrainMaxTimeout
+	}
+	return timeout
+}
+
+// waitIdleConns waits until no connection is tracked while closing the
+// connections that have been idle for DrainIdleTimeout. It returns false if
+// deadline elapses before that.
+func (srv *Server) waitIdleConns(deadline <-chan time.Time) bool {
+	for {
+		next, remaining := srv.closeIdleConns(srv.DrainIdleTimeout)
+		if remaining == 0 {
+			return true
+		}
+		timer := time.NewTimer(next)
+		select {
+		case <-timer.C:
+		case <-srv.connChanged:
+			timer.Stop()
+		case <-deadline:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// closeIdleConns closes the connections that have been idle for timeout.
+// It returns the duration until the next idle connection reaches timeout
+// and the number of the remaining connections.
+func (srv *Server) closeIdleConns(timeout time.Duration) (next time.Duration, remaining int) {
+	srv.mu.Lock()
+	var idle []net.Conn
+	next = timeout
+	for c, tc := range srv.conns {
+		if tc.state != http.StateNew && tc.state != http.StateIdle {
+			continue
+		}
+		if d := timeout - time.Since(tc.since); d > 0 {
+			if d < next {
+				next = d
+			}
+			continue
+		}
+		idle = append(idle, c)
+	}
+	remaining = len(srv.conns) - len(idle)
+	srv.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+		srv.trackConn(c, http.StateClosed)
+	}
+	return next, remaining
+}
+
+// closeConns closes the tracked connections forcibly except those that keep
+// reports true for the request being served. The closed connections are no
+// longer tracked since their handlers might never return. The responses that
+// have begun but not completed are counted and logged as truncated. It
+// returns the number of the kept connections.
+func (srv *Server) closeConns(keep func(r *http.Request) bool) (kept int) {
+	srv.mu.Lock()
+	conns := make(map[net.Conn]trackedConn, len(srv.conns))
+	for c, tc := range srv.conns {
+		conns[c] = *tc
+	}
+	srv.mu.Unlock()
+	closed, truncated := 0, 0
+	for c, tc := range conns {
+		if keep != nil && tc.req != nil && keep(tc.req) {
+			kept++
+			continue
+		}
+		srv.mu.Lock()
+		_, tracked := srv.conns[c]
+		srv.mu.Unlock()
+		if !tracked {
+			// It has been closed by itself in the meantime.
+			continue
+		}
+		c.Close()
+		srv.trackConn(c, http.StateClosed)
+		closed++
+		if tc.req != nil && tc.resp != nil && tc.resp.began() {
+			truncated++
+			srv.logf("miyabi: truncated the response to %s %s from %s", tc.req.Method, tc.req.URL.RequestURI(), tc.req.RemoteAddr)
+		}
+	}
+	if closed > 0 {
+		srv.truncated.Add(uint64(truncated))
+		srv.logf("miyabi: closed %d connections forcibly, %d responses were truncated", closed, truncated)
+	}
+	return kept
+}
+
+type listener interface {
+	net.Listener
+
+	File() (*os.File, error)
+}
+
+// listenerCreated calls ListenerCreated with l if it's set.
+func (srv *Server) listenerCreated(l net.Listener) {
+	if srv.ListenerCreated != nil {
+		srv.ListenerCreated(l)
+	}
+}
+
+// listenAddr listens on addr by Network. addr prefixed with "unix:" is
+// always a Unix domain socket. With ReusePort, the TCP port is reserved
+// instead of listened on.
+func (srv *Server) listenAddr(addr string) (listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return srv.listenUnix(addr[len("unix:"):])
+	}
+	switch network := srv.network(); network {
+	case "unix":
+		return srv.listenUnix(addr)
+	case "tcp", "tcp4", "tcp6":
+		if srv.ReusePort && runtime.GOOS != "windows" {
+			return reservePort(network, addr)
+		}
+		l, err := srv.listenTCP(addr)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+}
+
+// network returns Network, or "tcp" if empty.
+func (srv *Server) network() string {
+	if srv.Network == "" {
+		return "tcp"
+	}
+	return srv.Network
+}
+
+// listenUnix listens on the Unix domain socket addr. The socket file is
+// removed when the listener is closed, and a stale one left by a crashed
+// server is removed before listening.
+func (srv *Server) listenUnix(addr string) (listener, error) {
+	laddr, err := net.ResolveUnixAddr("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+	return net.ListenUnix("unix", laddr)
+}
+
+// removeStaleSocket removes the socket file path if no one is listening on
+// it. It does nothing if path doesn't exist or isn't a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	c, err := net.Dial("unix", path)
+	if err == nil {
+		c.Close()
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (srv *Server) listenTCP(addr string) (*tcpKeepAliveListener, error) {
+	laddr, err := net.ResolveTCPAddr(srv.network(), addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenTCP(srv.network(), laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpKeepAliveListener{l, srv.keepAlivePeriod(), srv.NoDelay}, nil
+}
+
+// tlsListener returns the listener that serves TLS with config on l. The
+// accepted connections are wrapped in serverConn under the TLS layer, after
+// their PROXY protocol header is read by proxyListener.
+func (srv *Server) tlsListener(l net.Listener, config *tls.Config) net.Listener {
+	return &serverTLSListener{tls.NewListener(&connListener{Listener: srv.proxyListener(l), srv: srv}, config)}
+}
+
+// serverTLSListener is the listener made by Server.tlsListener, which tells
+// proxyListener that the PROXY protocol header has been read under it.
+type serverTLSListener struct {
+	net.Listener
+}
+
+// proxyListener wraps l to read the PROXY protocol header if ProxyProtocol
+// is true. It's applied once for each listener: under the TLS listener by
+// tlsListener to read the header before the TLS handshake, to each listener
+// of ServeMulti, or to the listener of ServeContext otherwise.
+func (srv *Server) proxyListener(l net.Listener) net.Listener {
+	if !srv.ProxyProtocol {
+		return l
+	}
+	switch l.(type) {
+	case *serverTLSListener, *multiListener, *proxyListener:
+		// The header is read under l.
+		return l
+	}
+	return newProxyListener(l, srv)
+}
+
+// keepAlivePeriod returns KeepAlivePeriod, or its default if zero.
+func (srv *Server) keepAlivePeriod() time.Duration {
+	if srv.KeepAlivePeriod == 0 {
+		return defaultKeepAlivePeriod
+	}
+	return srv.KeepAlivePeriod
+}
+
+// listenTLS opens the TCP listener for ListenAndServeTLS. The listener
+// itself isn't wrapped in TLS since it's passed to the workers as a file.
+// The workers serve TLS on it with tlsConfig. The certificate is loaded
+// here as well in order to report the error before forking the workers.
+func (srv *Server) listenTLS(certFile, keyFile string) (listener, error) {
+	if _, err := srv.tlsConfig(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return srv.listenAddr(srv.tlsAddr())
+}
+
+// tlsAddr returns Addr, or ":https" if it's empty.
+func (srv *Server) tlsAddr() string {
+	if srv.Addr == "" {
+		return ":https"
+	}
+	return srv.Addr
+}
+
+// tlsConfig returns a copy of TLSConfig to serve TLS with. The certificate
+// is loaded from certFile and keyFile if they're given or TLSConfig has no
+// certificate, as http.Server.ServeTLS does. See ListenAndServeTLS. The other
+// settings such as ClientAuth, ClientCAs and VerifyPeerCertificate are kept
+// as they are, so mutual TLS is configured by TLSConfig.
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if config.NextProtos == nil {
+		if srv.TLSNextProto == nil && !srv.DisableHTTP2 {
+			// http.Server configures HTTP/2 by default.
+			config.NextProtos = []string{"h2"}
+		}
+		for proto := range srv.TLSNextProto {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+		slices.Sort(config.NextProtos)
+	}
+	if !slices.Contains(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+	hasCert := len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil
+	if hasCert && certFile == "" && keyFile == "" {
+		// The certificates are selected by TLSConfig, e.g. by SNI.
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// The certificate loaded from the files is the default, and the ones in
+	// TLSConfig.Certificates are still selected by SNI.
+	if config.GetCertificate != nil {
+		// GetCertificate of TLSConfig takes precedence, so the
+		// certificate can't be reloaded.
+		config.Certificates = append([]tls.Certificate{cert}, config.Certificates...)
+		return config, nil
+	}
+	srv.tlsCert.Store(&cert)
+	certs := config.Certificates
+	config.Certificates = nil
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := srv.tlsCert.Load()
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+		for i := range certs {
+			if hello.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+		return cert, nil
+	}
+	return config, nil
+}
+
+// ReloadTLS loads the certificate from certFile and keyFile, and replaces
+// the certificate that ListenAndServeTLS has loaded with it, e.g. to take a
+// renewed certificate into effect without a restart. The connections that
+// have been established keep the old certificate, and the new handshakes
+// present the new one. If it fails to load, the old certificate is kept.
+//
+// Since the worker serves TLS, it's valid in the worker of
+// ListenAndServeTLS, or in the process of ListenAndServeTLS on Windows; a
+// graceful restart loads the certificate files again in the new worker. It
+// returns an error if the certificate hasn't been loaded from the files,
+// including when TLSConfig has GetCertificate. It's safe to call from any
+// goroutine.
+func (srv *Server) ReloadTLS(certFile, keyFile string) error {
+	if srv.tlsCert.Load() == nil {
+		return errors.New("miyabi: no certificate loaded from files to reload")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.tlsCert.Store(&cert)
+	return nil
+}
+
+func (srv *Server) supervise(ctx context.Context, l listener) error {
+	// The files are written after dropping the privileges, so that the
+	// master can remove them as the same user.
+	if err := srv.dropPrivileges(); err != nil {
+		l.Close()
+		return err
+	}
+	if err := srv.removeShutdownMarker(); err != nil {
+		l.Close()
+		return err
+	}
+	if err := srv.writePidFile(); err != nil {
+		l.Close()
+		return err
+	}
+	defer srv.removePidFile()
+	if srv.ProcessTitle {
+		setProcessTitle(processTitle("master"))
+	}
+	if err := srv.waitForDependencies(ctx); err != nil {
+		l.Close()
+		return err
+	}
+	commands, stopFIFO, err := srv.watchControlFIFO()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	defer stopFIFO()
+	p, ready, err := srv.forkExec(l)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	if err := srv.waitReady(ctx, p, ready); err != nil {
+		l.Close()
+		return err
+	}
+	p.passState(nil)
+	actions := srv.signalActions()
+	// The signals that arrive while restarting are queued up so that they
+	// aren't dropped by signal.Notify.
+	c := make(chan os.Signal, max(len(actions), 1))
+	notify(c, actions, nil)
+	requests, stopRequests := srv.startMasterActions()
+	defer stopRequests()
+	srv.setMasterAddr(l.Addr())
+	defer srv.setMasterAddr(nil)
+	srv.workerPID.Store(int64(p.Pid))
+	defer srv.workerPID.Store(0)
+	srv.logf("miyabi: started worker %d on %v", p.Pid, l.Addr())
+	srv.setState(StateStart)
+	// respawn is set while the worker that has exited unexpectedly is
+	// waiting to be respawned, so that the actions such as shutdown are
+	// handled in the meantime.
+	var retry, rebindCheck, respawn <-chan time.Time
+	var crashes []time.Time
+	var pending []Action
+	if srv.Rebind {
+		ticker := time.NewTicker(rebindCheckInterval)
+		defer ticker.Stop()
+		rebindCheck = ticker.C
+	}
+	for {
+		restart := false
+		action := ActionIgnore
+		exited := p.exited
+		if respawn != nil {
+			exited = nil
+		}
+		if len(pending) > 0 {
+			action, pending = pending[0], pending[1:]
+		} else {
+			select {
+			case sig := <-c:
+				action = actions[sig]
+			case action = <-commands:
+			case action = <-requests:
+			case <-srv.ShutdownChan:
+				action = ActionShutdown
+			case <-srv.restartUnblocked():
+				restart = true
+			case <-retry:
+				restart = !srv.deferRestart()
+			case <-rebindCheck:
+				if srv.bindAddrGone(l) {
+					action = ActionRebind
+				}
+			case <-exited:
+				var delay time.Duration
+				if delay, crashes, err = srv.workerCrashed(p, crashes); err != nil {
+					l.Close()
+					srv.closeClosers()
+					return err
+				}
+				respawn = time.After(delay)
+				continue
+			case <-respawn:
+				respawn = nil
+				if p, err = srv.respawn(l); err != nil {
+					l.Close()
+					srv.closeClosers()
+					return err
+				}
+				continue
+			}
+		}
+		if respawn != nil {
+			// A new worker is about to be started anyway.
+			switch {
+			case restart || action == ActionRestart:
+				srv.logf("miyabi: restart is ignored while respawning the worker")
+				continue
+			case action == ActionRebind:
+				srv.logf("miyabi: rebind is ignored while respawning the worker")
+				continue
+			}
+		}
+		switch action {
+		case ActionRestart:
+			restart = !srv.deferRestart()
+		case ActionRebind:
+			if l, p, err = srv.rebind(l, p); err != nil {
+				return err
+			}
+			continue
+		case ActionShutdown, ActionForceShutdown:
+			signal.Stop(c)
+			l.Close()
+			// The pending respawn is canceled since the worker has
+			// already exited.
+			if respawn == nil {
+				srv.logf("miyabi: shutting down worker %d", p.Pid)
+				p.state.Close()
+				if action == ActionForceShutdown {
+					p.shutdown.Close()
+					p.Kill()
+					_, err = p.wait()
+				} else {
+					err = srv.shutdownWorker(p)
+				}
+				if err != nil {
+					srv.logf("miyabi: waiting for worker %d: %v", p.Pid, err)
+				}
+			}
+			srv.logf("miyabi: shut down")
+			srv.setState(StateShutdown)
+			if merr := srv.touchShutdownMarker(); err == nil {
+				err = merr
+			}
+			if cerr := srv.closeClosers(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+		if !restart {
+			continue
+		}
+		if srv.CanRestartNow != nil && !srv.CanRestartNow() {
+			if retry == nil {
+				srv.logf("miyabi: restart is deferred until CanRestartNow returns true")
+			}
+			retry = time.After(srv.restartRetryInterval())
+			continue
+		}
+		retry = nil
+		if p, pending, err = srv.restartWatching(l, p, c, actions, commands, requests); err != nil {
+			return err
+		}
+	}
+}
+
+// workerCrashed records the unexpected exit of the worker p, and returns the
+// delay until the new worker is started by respawn to keep
+// MinRestartInterval since the start of p. crashes are the times of the
+// previous unexpected exits, and the updated ones are returned. If the
+// workers have exited more than MaxRestarts times within RestartWindow, it
+// gives up and returns ErrCrashLoop.
+func (srv *Server) workerCrashed(p *worker, crashes []time.Time) (time.Duration, []time.Time, error) {
+	p.state.Close()
+	p.shutdown.Close()
+	srv.workerPID.Store(0)
+	srv.logf("miyabi: worker %d exited unexpectedly: %v", p.Pid, p.exitState)
+	srv.setState(StateWorkerExited)
+	now := time.Now()
+	window := srv.RestartWindow
+	if window <= 0 {
+		window = defaultRestartWindow
+	}
+	for len(crashes) > 0 && now.Sub(crashes[0]) > window {
+		crashes = crashes[1:]
+	}
+	crashes = append(crashes, now)
+	limit := srv.MaxRestarts
+	if limit == 0 {
+		limit = defaultMaxRestarts
+	}
+	if len(crashes) > limit {
+		srv.logf("miyabi: giving up, worker exited %d times within %v", len(crashes), window)
+		return 0, crashes, fmt.Errorf("%w: %d times within %v", ErrCrashLoop, len(crashes), window)
+	}
+	interval := srv.MinRestartInterval
+	if interval <= 0 {
+		interval = defaultMinRestartInterval
+	}
+	return interval - time.Since(p.started), crashes, nil
+}
+
+// respawn starts a new worker on l in place of the one that has exited
+// unexpectedly. If the new worker fails to become ready, it's returned as
+// well since it has exited, and then it's passed to workerCrashed in turn.
+func (srv *Server) respawn(l listener) (*worker, error) {
+	child, ready, err := srv.forkExec(l)
+	if err != nil {
+		return nil, err
+	}
+	// The context of the startup doesn't affect the respawns after it.
+	if err := srv.waitReady(context.Background(), child, ready); err != nil {
+		child.inheritedState.Close()
+		return child, nil
+	}
+	child.passState(nil)
+	srv.workerPID.Store(int64(child.Pid))
+	srv.logf("miyabi: respawned worker %d on %v", child.Pid, l.Addr())
+	return child, nil
+}
+
+// rebind opens a new listener on Addr and restarts the worker p on it. It
+// returns the new listener and worker. If either fails to start, the current
+// listener l and p are kept.
+func (srv *Server) rebind(l listener, p *worker) (listener, *worker, error) {
+	if srv.listen == nil {
+		return l, p, nil
+	}
+	nl, err := srv.listen()
+	if err != nil {
+		srv.logf("miyabi: rebind failed, the current listener is kept: %v", err)
+		return l, p, nil
+	}
+	srv.listenerCreated(nl)
+	child, err := srv.restart(context.Background(), nl, p)
+	if err != nil || child == p {
+		nl.Close()
+		return l, p, err
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		// Don't remove the socket file of the new listener.
+		ul.SetUnlinkOnClose(false)
+	}
+	l.Close()
+	srv.setMasterAddr(nl.Addr())
+	srv.logf("miyabi: rebound the listener from %v to %v", l.Addr(), nl.Addr())
+	return nl, child, nil
+}
+
+// bindAddrGone reports whether the address of l is no longer available. See
+// Rebind.
+func (srv *Server) bindAddrGone(l net.Listener) bool {
+	switch addr := l.Addr().(type) {
+	case *net.UnixAddr:
+		_, err := os.Stat(addr.Name)
+		return os.IsNotExist(err)
+	case *net.TCPAddr:
+		if addr.IP.IsUnspecified() {
+			return false
+		}
+		if host, _, err := net.SplitHostPort(srv.Addr); err == nil && host != "" {
+			if ips, err := net.LookupIP(host); err == nil && !containsIP(ips, addr.IP) {
+				return true
+			}
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-// ListenAndServeTLS acts like http.ListenAndServeTLS but can be graceful
-// shutdown and restart.
-func ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
-	server := &Server{Addr: addr, Handler: handler}
-	return server.ListenAndServeTLS(certFile, keyFile)
+// startMasterActions returns the channel that receives the actions requested
+// by Shutdown and Restart while supervising, and the function to stop
+// receiving them.
+func (srv *Server) startMasterActions() (<-chan Action, func()) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	actions, supervised := make(chan Action), make(chan struct{})
+	srv.masterActions, srv.supervised = actions, supervised
+	return actions, func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.masterActions = nil
+		close(supervised)
+	}
 }
 
-// Server is similar to http.Server.
-// However, ListenAndServe, ListenAndServeTLS and Serve can be graceful
-// shutdown and restart.
-type Server http.Server
+// restartRetryInterval returns RestartRetryInterval or its default.
+func (srv *Server) restartRetryInterval() time.Duration {
+	if srv.RestartRetryInterval > 0 {
+		return srv.RestartRetryInterval
+	}
+	return defaultRestartRetryInterval
+}
 
-// ListenAndServe acts like http.Server.ListenAndServe but can be graceful
-// shutdown and restart. If srv.Addr begin with "unix:", will listen on a Unix
-// domain socket instead of TCP.
-func (srv *Server) ListenAndServe() error {
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":http"
+// waitForDependencies calls WaitForDependencies within DependenciesTimeout.
+func (srv *Server) waitForDependencies(ctx context.Context) error {
+	if srv.WaitForDependencies == nil {
+		return nil
 	}
-	if runtime.GOOS == "windows" {
-		l, err := srv.listenTCP(addr)
-		if err != nil {
-			return err
+	if srv.DependenciesTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.DependenciesTimeout)
+		defer cancel()
+	}
+	if err := srv.WaitForDependencies(ctx); err != nil {
+		return fmt.Errorf("miyabi: dependencies aren't ready: %w", err)
+	}
+	return nil
+}
+
+// restartWatching restarts the worker p on l while watching for the actions
+// from the signals c, commands, requests and ShutdownChan, which arrive
+// meanwhile. They are
+// returned with the new worker to be taken next. Shutdown takes precedence:
+// once it arrives, the restart is canceled unless the new worker has already
+// been promoted, and only the shutdown is returned.
+func (srv *Server) restartWatching(l listener, p *worker, c <-chan os.Signal, actions map[os.Signal]Action, commands, requests <-chan Action) (*worker, []Action, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pending []Action
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdownChan := srv.ShutdownChan
+		for {
+			action := ActionIgnore
+			select {
+			case sig := <-c:
+				action = actions[sig]
+			case action = <-commands:
+			case action = <-requests:
+			case <-shutdownChan:
+				// It may have been closed.
+				shutdownChan = nil
+				action = ActionShutdown
+			case <-done:
+				return
+			}
+			switch {
+			case action == ActionShutdown || action == ActionForceShutdown:
+				if len(pending) == 0 || pending[0] != ActionForceShutdown {
+					pending = []Action{action}
+				}
+				cancel()
+			case action != ActionIgnore && ctx.Err() == nil:
+				pending = append(pending, action)
+			}
 		}
-		return srv.Serve(l)
+	}()
+	child, err := srv.restart(ctx, l, p)
+	close(done)
+	<-stopped
+	return child, pending, err
+}
+
+// restart forks a new worker and then stops the old worker p.
+// It returns the new worker, or p if the new worker fails to start or ctx
+// is canceled before it becomes ready.
+func (srv *Server) restart(ctx context.Context, l listener, p *worker) (*worker, error) {
+	srv.logf("miyabi: restarting worker %d", p.Pid)
+	child, ready, err := srv.forkExec(l)
+	if err != nil {
+		// Even a transient failure such as EMFILE from dup(2) for the
+		// listener mustn't take down the running worker.
+		srv.logf("miyabi: restart failed, the old worker keeps running: %v", err)
+		srv.setState(StateRestartFailed)
+		return p, nil
 	}
-	if IsMaster() {
-		var l listener
-		var err error
-		if strings.HasPrefix(addr, "unix:") {
-			l, err = srv.listenUnix(addr[len("unix:"):])
-		} else {
-			l, err = srv.listenTCP(addr)
+	if err := srv.waitReady(ctx, child, ready); err != nil {
+		child.state.Close()
+		child.inheritedState.Close()
+		child.shutdown.Close()
+		if ctx.Err() != nil {
+			srv.logf("miyabi: restart canceled by shutdown, worker %d has been killed", child.Pid)
+			return p, nil
 		}
-		if err != nil {
+		srv.logf("miyabi: restart aborted, the old worker keeps running: %v", err)
+		srv.setState(StateRestartFailed)
+		return p, nil
+	}
+	srv.workerPID.Store(int64(child.Pid))
+	if srv.OnPromote != nil {
+		srv.OnPromote(p.Pid, child.Pid)
+	}
+	state := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(p.state)
+		state <- b
+	}()
+	if err := srv.stopProcess(p); err != nil {
+		srv.logf("miyabi: waiting for worker %d: %v", p.Pid, err)
+	}
+	// The pipe may be kept open by processes that the old worker has
+	// spawned, so don't wait for EOF forever.
+	p.state.SetReadDeadline(time.Now().Add(srv.timeout()))
+	b := <-state
+	p.state.Close()
+	p.shutdown.Close()
+	child.passState(b)
+	srv.logf("miyabi: restarted, worker %d replaced %d", child.Pid, p.Pid)
+	srv.setState(StateRestart)
+	if srv.HealthCheckURL != "" {
+		if err := srv.checkHealth(); err != nil {
+			srv.logf("miyabi: restarted worker is unhealthy: %v", err)
+			srv.setState(StateRestartUnhealthy)
+		}
+	}
+	return child, nil
+}
+
+// checkHealth probes HealthCheckURL until it responds with 2xx status code
+// or HealthCheckTimeout elapses.
+func (srv *Server) checkHealth() error {
+	timeout := srv.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := client.Get(srv.HealthCheckURL)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("GET %s: %s", srv.HealthCheckURL, res.Status)
+		}
+		if time.Now().After(deadline) {
 			return err
 		}
-		return srv.supervise(l)
+		time.Sleep(healthCheckInterval)
 	}
-	ln, err := srv.listenerFromFDEnv()
-	if err != nil {
-		return err
+}
+
+// waitReady waits for the worker p to notify that it's ready to serve
+// through the pipe ready. If p doesn't become ready within ReadyTimeout or
+// before ctx expires, p will be killed.
+func (srv *Server) waitReady(ctx context.Context, p *worker, ready *os.File) error {
+	defer ready.Close()
+	timeout := srv.ReadyTimeout
+	if timeout <= 0 {
+		timeout = srv.timeout()
 	}
-	return srv.Serve(ln)
+	if timeout > 0 {
+		ready.SetReadDeadline(time.Now().Add(timeout))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		ready.SetReadDeadline(aLongTimeAgo)
+	})
+	_, err := ready.Read(make([]byte, 1))
+	stop()
+	if err == nil {
+		return nil
+	}
+	p.Kill()
+	p.wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == io.EOF {
+		return fmt.Errorf("miyabi: worker %d exited before it became ready", p.Pid)
+	}
+	return fmt.Errorf("miyabi: worker %d didn't become ready: %v", p.Pid, err)
 }
 
-// ListenAndServeTLS acts like http.Server.ListenAndServeTLS but can be
-// graceful shutdown and restart.
-func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
-	if IsMaster() {
-		l, err := srv.listenTLS(certFile, keyFile)
+// notifyReady notifies the master that the worker is ready to serve.
+// It does nothing if the current process isn't a worker or has already
+// notified.
+func notifyReady() {
+	readyOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(readyFDEnvKey))
 		if err != nil {
-			return err
+			return
+		}
+		f := os.NewFile(uintptr(fd), "ready pipe")
+		f.Write([]byte{1})
+		f.Close()
+	})
+}
+
+// stopProcess sends ShutdownSignal to p and waits for it to exit.
+// p will be killed if it doesn't exit within Timeout.
+func (srv *Server) stopProcess(p *worker) error {
+	p.Signal(srv.shutdownSignal())
+	return srv.waitOrKill(p, srv.timeout())
+}
+
+// waitOrKill waits for p to exit, and kills p if it doesn't exit within
+// timeout. A zero timeout waits without limit. In the meantime,
+// EscalationSignals are sent to p. The forced kill is reported
+// to Logger and OnForceKill.
+func (srv *Server) waitOrKill(p *worker, timeout time.Duration) error {
+	for _, e := range srv.EscalationSignals {
+		if timeout > 0 && e.After >= timeout {
+			continue
 		}
-		return srv.supervise(l)
+		e := e
+		timer := time.AfterFunc(e.After, func() {
+			srv.logf("miyabi: worker %d hasn't exited for %v, sending %v", p.Pid, e.After, e.Signal)
+			p.Signal(e.Signal)
+		})
+		defer timer.Stop()
 	}
-	ln, err := srv.listenerFromFDEnv()
+	var fired atomic.Bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			// Set it before killing so that Wait can't return first.
+			fired.Store(true)
+			if err := p.Kill(); err != nil {
+				// p has exited already, and Kill doesn't signal it.
+				fired.Store(false)
+			}
+		})
+		defer timer.Stop()
+	}
+	state, err := p.wait()
 	if err != nil {
 		return err
 	}
-	return srv.Serve(ln)
+	// p may have exited by itself before it's reaped by Wait.
+	if fired.Load() && killedBySIGKILL(state) {
+		srv.logf("miyabi: worker %d didn't exit within %v and has been killed", p.Pid, timeout)
+		if srv.OnForceKill != nil {
+			srv.OnForceKill(p.Pid)
+		}
+	}
+	return nil
 }
 
-// Serve acts like http.Server.Serve but can be graceful shutdown.
-// If you want to graceful restart, use ListenAndServe or ListenAndServeTLS instead.
-func (srv *Server) Serve(l net.Listener) error {
-	conns := make(map[net.Conn]struct{})
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	srv.ConnState = func(conn net.Conn, state http.ConnState) {
-		mu.Lock()
-		switch state {
-		case http.StateActive:
-			conns[conn] = struct{}{}
-			wg.Add(1)
-		case http.StateIdle, http.StateClosed:
-			if _, exists := conns[conn]; exists {
-				delete(conns, conn)
-				wg.Done()
-			}
-		}
-		mu.Unlock()
+// killedBySIGKILL reports whether the process of state has been terminated
+// by SIGKILL.
+func killedBySIGKILL(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
+
+// shutdownSignal returns ShutdownSignal of srv, or the package-level
+// ShutdownSignal if it's nil.
+func (srv *Server) shutdownSignal() os.Signal {
+	if srv.ShutdownSignal != nil {
+		return srv.ShutdownSignal
 	}
-	srv.startWaitSignals(l)
-	err := (*http.Server)(srv).Serve(l)
-	wg.Wait()
-	if err, ok := err.(*net.OpError); ok {
-		op := err.Op
-		if runtime.GOOS == "windows" && op == "AcceptEx" {
-			op = "accept"
-		}
-		if op == "accept" && err.Err.Error() == "use of closed network connection" {
-			return nil
-		}
+	return ShutdownSignal
+}
+
+// restartSignal returns RestartSignal of srv, or the package-level
+// RestartSignal if it's nil.
+func (srv *Server) restartSignal() os.Signal {
+	if srv.RestartSignal != nil {
+		return srv.RestartSignal
 	}
-	return err
+	return RestartSignal
 }
 
-// SetKeepAlivesEnabled is same as http.Server.SetKeepAlivesEnabled.
-func (srv *Server) SetKeepAlivesEnabled(v bool) {
-	(*http.Server)(srv).SetKeepAlivesEnabled(v)
+// timeout returns Timeout of srv, or the package-level Timeout if it's zero.
+func (srv *Server) timeout() time.Duration {
+	if srv.Timeout != 0 {
+		return srv.Timeout
+	}
+	return Timeout
 }
 
-type listener interface {
-	net.Listener
+// BlockRestarts blocks graceful restarts until UnblockRestarts is called.
+// While blocked, received RestartSignals are deferred and coalesced into
+// a single restart that is performed when unblocked. Calls may be nested;
+// restarts are unblocked when every BlockRestarts call has been matched by
+// UnblockRestarts.
+//
+// Restarts are performed by the master process, so BlockRestarts only has
+// effect when it is called in the master.
+func (srv *Server) BlockRestarts() {
+	srv.restartMu.Lock()
+	defer srv.restartMu.Unlock()
+	srv.restartBlocks++
+}
 
-	File() (*os.File, error)
+// UnblockRestarts unblocks graceful restarts blocked by BlockRestarts.
+// If RestartSignal was received while blocked, the server is restarted.
+func (srv *Server) UnblockRestarts() {
+	srv.restartMu.Lock()
+	defer srv.restartMu.Unlock()
+	if srv.restartBlocks == 0 {
+		return
+	}
+	srv.restartBlocks--
+	if srv.restartBlocks == 0 && srv.restartPending {
+		srv.restartPending = false
+		// A restart that is already notified covers this one, and
+		// blocking here with restartMu held would deadlock the master.
+		select {
+		case srv.unblockedChan() <- struct{}{}:
+		default:
+		}
+	}
 }
 
-func (srv *Server) listenUnix(addr string) (listener, error) {
-	laddr, err := net.ResolveUnixAddr("unix", addr)
-	if err != nil {
-		return nil, err
+// deferRestart reports whether a restart should be deferred because
+// restarts are blocked. If so, the restart is marked as pending.
+func (srv *Server) deferRestart() bool {
+	srv.restartMu.Lock()
+	defer srv.restartMu.Unlock()
+	if srv.restartBlocks == 0 {
+		return false
 	}
-	return net.ListenUnix("unix", laddr)
+	srv.restartPending = true
+	return true
 }
 
-func (srv *Server) listenTCP(addr string) (*tcpKeepAliveListener, error) {
-	laddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return nil, err
+// restartUnblocked returns the channel that receives a value when the
+// pending restart is unblocked.
+func (srv *Server) restartUnblocked() <-chan struct{} {
+	srv.restartMu.Lock()
+	defer srv.restartMu.Unlock()
+	return srv.unblockedChan()
+}
+
+// unblockedChan must be called with srv.restartMu held.
+func (srv *Server) unblockedChan() chan struct{} {
+	if srv.unblocked == nil {
+		srv.unblocked = make(chan struct{}, 1)
 	}
-	l, err := net.ListenTCP("tcp", laddr)
+	return srv.unblocked
+}
+
+func (srv *Server) listenerFromFDEnv(addr string) (net.Listener, error) {
+	fds, err := srv.getFDs()
 	if err != nil {
 		return nil, err
 	}
-	return &tcpKeepAliveListener{l}, nil
-}
-
-func (srv *Server) listenTLS(certFile, keyFile string) (listener, error) {
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":https"
+	name := srv.ListenerName
+	if name == "" {
+		name = addr
 	}
-	config := &tls.Config{}
-	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+	var listeners []net.Listener
+	for i, fd := range fds {
+		file := os.NewFile(fd, "listen socket "+name)
+		reusePort := i == 0 && os.Getenv(reusePortEnvKey) != ""
+		var l listener
+		err := checkListenerFile(file, reusePort)
+		if err != nil {
+			file.Close()
+			key := srv.fdEnvKey()
+			err = fmt.Errorf("%w %d in %s=%q: %s: %v", ErrInvalidFD, fd, key, os.Getenv(key), file.Name(), err)
+		} else if reusePort {
+			l, err = srv.reusePortListener(file)
+		} else {
+			l, err = srv.fileListener(file)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
 	}
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+	if len(listeners) == 1 {
+		return listeners[0], nil
 	}
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	return newMultiListener(listeners), nil
+}
+
+// fileListener returns the listener of the listening socket file, and closes
+// file.
+func (srv *Server) fileListener(file *os.File) (listener, error) {
+	// net.FileListener duplicates the fd, so the inherited one is closed
+	// in any case not to leak it.
+	defer file.Close()
+	l, err := net.FileListener(file)
 	if err != nil {
 		return nil, err
 	}
-	ln, err := srv.listenTCP(addr)
-	if err != nil {
-		return nil, err
+	switch l := l.(type) {
+	case *net.UnixListener:
+		// The socket file is shared with the master and the next worker,
+		// so leave it to the master to remove it.
+		l.SetUnlinkOnClose(false)
+		return l, nil
+	case *net.TCPListener:
+		return tcpKeepAliveListener{l, srv.keepAlivePeriod(), srv.NoDelay}, nil
 	}
-	tlsListener := tls.NewListener(ln, config)
-	return tlsListener.(listener), nil
+	l.Close()
+	return nil, fmt.Errorf("miyabi: unsupported listener %T", l)
 }
 
-func (srv *Server) startWaitSignals(l net.Listener) {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT, ShutdownSignal)
-	go func() {
-		sig := <-c
-		srv.SetKeepAlivesEnabled(false)
-		switch sig {
-		case syscall.SIGINT, ShutdownSignal:
-			signal.Stop(c)
-			l.Close()
+// checkInheritedAddr warns if the inherited listener isn't bound to addr.
+// It happens when Addr is changed after the master has bound the socket.
+// The sockets activated by systemd aren't bound to Addr, so they aren't
+// checked.
+func (srv *Server) checkInheritedAddr(addr string, actual net.Addr) {
+	if os.Getenv(activatedEnvKey) != "" {
+		return
+	}
+	if !matchAddr(addr, actual) {
+		srv.logf("miyabi: Addr %q differs from the inherited listener address %q; Addr is ignored after the first bind", addr, actual)
+	}
+}
+
+// matchAddr reports whether the listener address actual satisfies addr.
+// An unspecified host or a zero port in addr matches any host or port.
+func matchAddr(addr string, actual net.Addr) bool {
+	switch a := actual.(type) {
+	case *net.UnixAddr:
+		return strings.TrimPrefix(addr, "unix:") == a.Name
+	case *net.TCPAddr:
+		taddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return false
 		}
-	}()
+		if taddr.Port != 0 && taddr.Port != a.Port {
+			return false
+		}
+		return taddr.IP == nil || taddr.IP.IsUnspecified() || taddr.IP.Equal(a.IP)
+	}
+	return true
 }
 
-func (srv *Server) supervise(l listener) error {
-	p, err := srv.forkExec(l)
-	if err != nil {
-		return err
+// getFDs gets file descriptors of listen sockets from environment variable,
+// or receives them over the unix socket in it with UnixSocketFD. The
+// inherited ones start from 3, next to stdin, stdout and stderr.
+func (srv *Server) getFDs() ([]uintptr, error) {
+	key := srv.fdEnvKey()
+	fdStr := os.Getenv(key)
+	if fdStr == "" {
+		return nil, errNotForked
 	}
-	if ServerState != nil {
-		ServerState(StateStart)
+	if s, ok := strings.CutPrefix(fdStr, fdSocketPrefix); ok {
+		fd, err := strconv.Atoi(s)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("%w %q in %s=%q", ErrInvalidFD, s, key, fdStr)
+		}
+		fds, err := receiveFDs(fd)
+		if err != nil {
+			return nil, fmt.Errorf("%w in %s=%q: receiving the listeners: %v", ErrInvalidFD, key, fdStr, err)
+		}
+		return fds, nil
 	}
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT, ShutdownSignal, RestartSignal)
-	for {
-		switch sig := <-c; sig {
-		case RestartSignal:
-			child, err := srv.forkExec(l)
-			if err != nil {
-				return err
-			}
-			p.Signal(ShutdownSignal)
-			timer := time.AfterFunc(Timeout, func() {
-				p.Kill()
-			})
-			p.Wait()
-			timer.Stop()
-			p = child
-			if ServerState != nil {
-				ServerState(StateRestart)
-			}
-		case syscall.SIGINT, ShutdownSignal:
-			signal.Stop(c)
-			l.Close()
-			p.Signal(ShutdownSignal)
-			timer := time.AfterFunc(Timeout, func() {
-				p.Kill()
-			})
-			_, err := p.Wait()
-			timer.Stop()
-			if ServerState != nil {
-				ServerState(StateShutdown)
-			}
-			return err
+	var fds []uintptr
+	for _, s := range strings.Split(fdStr, ",") {
+		fd, err := strconv.Atoi(s)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("%w %q in %s=%q", ErrInvalidFD, s, key, fdStr)
 		}
+		fds = append(fds, uintptr(fd))
 	}
+	return fds, nil
 }
 
-func (srv *Server) listenerFromFDEnv() (net.Listener, error) {
-	fd, err := srv.getFD()
+// forkExec starts a worker that inherits the listener l. It returns the
+// worker and the read end of the pipe to wait for the worker to be ready.
+func (srv *Server) forkExec(l listener) (*worker, *os.File, error) {
+	progName, err := srv.executable()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	file := os.NewFile(fd, "listen socket")
-	defer file.Close()
-	l, err := net.FileListener(file)
+	pwd := srv.workingDir(progName)
+	f, err := l.File()
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("miyabi: passing the listener to the worker: %w", err)
 	}
-	if l, ok := l.(*net.UnixListener); ok {
-		addr := l.Addr().String()
-		if _, err := os.Stat(addr); err == nil {
-			if err := os.Remove(addr); err != nil {
-				return nil, err
+	defer f.Close()
+	var pipes [4][2]*os.File
+	defer func() {
+		for _, pipe := range pipes {
+			for _, f := range pipe {
+				if f != nil {
+					f.Close()
+				}
 			}
 		}
-		return srv.listenUnix(addr)
+	}()
+	for i := range pipes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		pipes[i] = [2]*os.File{r, w}
+	}
+	ready, state, inheritedState, shutdown := pipes[0], pipes[1], pipes[2], pipes[3]
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, f, ready[1], state[1], inheritedState[0], shutdown[0]}
+	var extraFDs []string
+	for _, f := range srv.ExtraFiles {
+		extraFDs = append(extraFDs, strconv.Itoa(len(files)))
+		files = append(files, f)
+	}
+	listeners := []*os.File{f}
+	for _, l := range srv.extraListeners {
+		f, err := l.File()
+		if err != nil {
+			return nil, nil, fmt.Errorf("miyabi: passing the listener to the worker: %w", err)
+		}
+		defer f.Close()
+		listeners = append(listeners, f)
+	}
+	var fdValue string
+	var sock *os.File
+	if srv.FDTransport == UnixSocketFD {
+		var peer *os.File
+		if sock, peer, err = socketPair(); err != nil {
+			return nil, nil, fmt.Errorf("miyabi: passing the listener to the worker: %w", err)
+		}
+		defer sock.Close()
+		defer peer.Close()
+		files[3] = peer
+		fdValue = fdSocketPrefix + "3"
+	} else {
+		fds := []string{"3"}
+		for _, f := range listeners[1:] {
+			fds = append(fds, strconv.Itoa(len(files)))
+			files = append(files, f)
+		}
+		fdValue = strings.Join(fds, ",")
+	}
+	argv, env := os.Args, os.Environ()
+	if srv.ChildArgs != nil {
+		argv = append([]string{os.Args[0]}, srv.ChildArgs...)
+	}
+	if srv.ChildEnv != nil {
+		env = append([]string(nil), srv.ChildEnv...)
+	}
+	srv.generation++
+	env = append(env,
+		fmt.Sprintf("%s=%s", srv.fdEnvKey(), fdValue),
+		fmt.Sprintf("%s=%d", readyFDEnvKey, 4),
+		fmt.Sprintf("%s=%d", stateFDEnvKey, 5),
+		fmt.Sprintf("%s=%d", inheritedStateFDEnvKey, 6),
+		fmt.Sprintf("%s=%d", shutdownFDEnvKey, 7),
+		fmt.Sprintf("%s=%s", extraFDsEnvKey, strings.Join(extraFDs, ",")),
+		fmt.Sprintf("%s=%d", generationEnvKey, srv.generation))
+	if _, ok := l.(*reservedPort); ok {
+		env = append(env, reusePortEnvKey+"=1")
+	}
+	if srv.activated {
+		env = append(env, activatedEnvKey+"=1")
+	}
+	p, err := startProcess(progName, argv, pwd, env, files, srv.KillChildWithParent)
+	if err != nil {
+		return nil, nil, err
 	}
-	return tcpKeepAliveListener{l.(*net.TCPListener)}, nil
+	if sock != nil {
+		if err := sendFDs(sock, listeners); err != nil {
+			// It's reaped here since the goroutine below won't wait for
+			// it.
+			p.Kill()
+			p.Wait()
+			return nil, nil, fmt.Errorf("miyabi: passing the listener to the worker: %w", err)
+		}
+	}
+	w := &worker{
+		Process:        p,
+		state:          state[0],
+		inheritedState: inheritedState[1],
+		shutdown:       shutdown[1],
+		started:        time.Now(),
+		exited:         make(chan struct{}),
+	}
+	go func() {
+		w.exitState, w.exitErr = p.Wait()
+		close(w.exited)
+	}()
+	pipes[0][0], pipes[1][0], pipes[2][1], pipes[3][1] = nil, nil, nil, nil
+	return w, ready[0], nil
 }
 
-// getFD gets file descriptor of listen socket from environment variable.
-func (srv *Server) getFD() (uintptr, error) {
-	fdStr := os.Getenv(FDEnvKey)
-	if fdStr == "" {
-		return 0, errNotForked
+// executable returns the path of the program to fork the worker from,
+// which is ExecutablePath or the executable of the current process.
+func (srv *Server) executable() (string, error) {
+	path := srv.ExecutablePath
+	if path == "" {
+		p, err := os.Executable()
+		if err != nil {
+			return "", err
+		}
+		path = p
+	} else if p, err := filepath.Abs(path); err == nil {
+		// It must not be resolved from WorkingDir of the worker.
+		path = p
 	}
-	fd, err := strconv.Atoi(fdStr)
-	if err != nil {
-		return 0, err
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("miyabi: executable %s has been removed; set ExecutablePath to the new one: %w", path, err)
+		}
+		return "", err
 	}
-	return uintptr(fd), nil
+	return path, nil
 }
 
-func (srv *Server) forkExec(l listener) (*os.Process, error) {
-	progName, err := exec.LookPath(os.Args[0])
-	if err != nil {
-		return nil, err
+// workingDir returns the working directory of the worker to fork from
+// progName. If the current working directory can't be determined, e.g.
+// because it has been removed, it falls back to the directory of progName
+// with a warning.
+func (srv *Server) workingDir(progName string) string {
+	if srv.WorkingDir != "" {
+		return srv.WorkingDir
 	}
 	pwd, err := os.Getwd()
-	if err != nil {
-		return nil, err
+	if err == nil {
+		return pwd
 	}
-	f, err := l.File()
-	if err != nil {
-		return nil, err
+	dir := filepath.Dir(progName)
+	if !filepath.IsAbs(dir) {
+		dir = string(filepath.Separator)
 	}
-	defer f.Close()
-	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, f}
-	fdEnv := fmt.Sprintf("%s=%d", FDEnvKey, len(files)-1)
-	return os.StartProcess(progName, os.Args, &os.ProcAttr{
-		Dir:   pwd,
-		Env:   append(os.Environ(), fdEnv),
-		Files: files,
-	})
+	srv.logf("miyabi: working directory is unavailable, the worker runs in %s: %v", dir, err)
+	return dir
+}
+
+// worker is a worker process forked by the master.
+type worker struct {
+	*os.Process
+
+	// state is the read end of the pipe that the worker writes its
+	// RestartState to.
+	state *os.File
+
+	// inheritedState is the write end of the pipe that the worker reads
+	// the state of the old worker from.
+	inheritedState *os.File
+
+	// shutdown is the write end of the pipe to notify the worker of the
+	// final shutdown.
+	shutdown *os.File
+
+	// started is the time when the worker has been started.
+	started time.Time
+
+	// exited is closed when the worker exits, and then exitState and
+	// exitErr hold the results of Wait. The worker is waited for only by
+	// the goroutine started by forkExec, so that the master can notice an
+	// unexpected exit while others wait for it by wait.
+	exited    chan struct{}
+	exitState *os.ProcessState
+	exitErr   error
+}
+
+// Signal sends sig to the worker like os.Process.Signal unless it has
+// exited, so that the timers that fire just after the exit never signal
+// the pid that may have been recycled. os.Process refuses to signal a
+// reaped process as well, but this doesn't depend on it.
+func (w *worker) Signal(sig os.Signal) error {
+	select {
+	case <-w.exited:
+		return os.ErrProcessDone
+	default:
+	}
+	return w.Process.Signal(sig)
+}
+
+// Kill kills the worker like os.Process.Kill unless it has exited.
+func (w *worker) Kill() error {
+	select {
+	case <-w.exited:
+		return os.ErrProcessDone
+	default:
+	}
+	return w.Process.Kill()
+}
+
+// wait waits for the worker to exit like os.Process.Wait.
+func (w *worker) wait() (*os.ProcessState, error) {
+	<-w.exited
+	return w.exitState, w.exitErr
+}
+
+// passState passes the state b of the old worker to w in the background,
+// and then closes the pipe.
+func (w *worker) passState(b []byte) {
+	f := w.inheritedState
+	go func() {
+		f.Write(b)
+		f.Close()
+	}()
 }
 
 // tcpKeepAliveListener is copy from net/http.
 type tcpKeepAliveListener struct {
 	*net.TCPListener
+
+	// period is the keep-alive period. If negative, keep-alive is disabled.
+	period time.Duration
+
+	// noDelay is whether to set TCP_NODELAY explicitly.
+	noDelay bool
 }
 
 // Accept is copy from net/http.
@@ -335,18 +2991,88 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if ln.noDelay {
+		tc.SetNoDelay(true)
+	}
+	if ln.period < 0 {
+		tc.SetKeepAlive(false)
+		return tc, nil
+	}
 	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
+	tc.SetKeepAlivePeriod(ln.period)
 	return tc, nil
 }
 
+// ExtraFiles returns the files passed by Server.ExtraFiles of the master in
+// the same order. It returns nil in the master. Each call returns new
+// *os.File values of the same file descriptors, so close them only once.
+func ExtraFiles() []*os.File {
+	var files []*os.File
+	for _, s := range strings.Split(os.Getenv(extraFDsEnvKey), ",") {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			continue
+		}
+		files = append(files, os.NewFile(uintptr(fd), "extra file "+s))
+	}
+	return files
+}
+
 // IsMaster returns whether the current process is master.
+// It only sees the package-level FDEnvKey, not Server.FDEnvKey.
 func IsMaster() bool {
 	return os.Getenv(FDEnvKey) == ""
 }
 
+// IsWorker returns whether the current process is a worker, which is the
+// opposite of IsMaster. It only sees the package-level FDEnvKey, not
+// Server.FDEnvKey.
+func IsWorker() bool {
+	return !IsMaster()
+}
+
+// IsMaster returns whether the current process is the master of srv rather
+// than its worker. The master is the supervisor that binds the listener and
+// forks the workers, and the workers serve the requests. For example, a
+// debug port may be bound only in the master, and the migrations may be run
+// only in the worker. Unlike the package-level IsMaster, it sees FDEnvKey of
+// srv. A process that serves by itself, such as Serve called directly or
+// ListenAndServe on Windows, is also a master.
+func (srv *Server) IsMaster() bool {
+	return os.Getenv(srv.fdEnvKey()) == ""
+}
+
+// fdEnvKey returns FDEnvKey of srv, or the package-level FDEnvKey if it's
+// empty.
+func (srv *Server) fdEnvKey() string {
+	if srv.FDEnvKey != "" {
+		return srv.FDEnvKey
+	}
+	return FDEnvKey
+}
+
+// An FDTransport represents the way to pass the listeners from the master
+// to the workers. It's used by Server.FDTransport.
+type FDTransport uint8
+
+const (
+	// EnvFD passes the listeners as the inherited file descriptors, which
+	// are listed in the environment variable of FDEnvKey.
+	EnvFD FDTransport = iota
+
+	// UnixSocketFD sends the listeners over a unix socket pair by
+	// SCM_RIGHTS, so that their numbers in the workers don't depend on the
+	// environment variable. Only the socket is inherited. It isn't
+	// supported on Windows.
+	UnixSocketFD
+)
+
 // A State represents the state of the server.
 // It's used by the optional ServerState hook.
+//
+// StateReady is fired in the process that serves requests, i.e. the worker
+// of ListenAndServe and ListenAndServeTLS or the process calling Serve. The
+// others are fired in the master.
 type State uint8
 
 const (
@@ -358,4 +3084,23 @@ const (
 
 	// StateShutdown represents a state that server has been shutdown.
 	StateShutdown
+
+	// StateRestartUnhealthy represents a state that server has been
+	// restarted but the new worker didn't pass the health check.
+	StateRestartUnhealthy
+
+	// StateReady represents a state that server is about to accept
+	// connections in the serving process. It's fired by every worker,
+	// including the new one of each graceful restart.
+	StateReady
+
+	// StateRestartFailed represents a state that server has failed to
+	// restart because the new worker couldn't be started or didn't become
+	// ready. The old worker keeps serving.
+	StateRestartFailed
+
+	// StateWorkerExited represents a state that the worker has exited
+	// unexpectedly, i.e. not by shutdown or restart. The master respawns it
+	// unless the crash loop protection gives up. See MaxRestarts.
+	StateWorkerExited
 )
@@ -1,11 +1,24 @@
 package miyabi_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -17,6 +30,158 @@ const (
 	addr = "127.0.0.1:0"
 )
 
+func TestMain(m *testing.M) {
+	if !miyabi.IsMaster() || os.Getenv("MIYABI_TEST_FD_ENV_KEY") != "" {
+		// The test binary is running as a worker forked by a master in
+		// the tests.
+		os.Exit(runWorker())
+	}
+	os.Exit(m.Run())
+}
+
+// runWorker serves the inherited listener as a worker of the tests. The
+// handler responds the pid of the worker, or on the following paths:
+//
+//	/cwd         the working directory
+//	/exe         the executable
+//	/state       the state inherited from the old worker
+//	/args        the arguments and MIYABI_TEST_CHILD_ENV
+//	/extra       the file descriptor and the content of ExtraFiles[0]
+//	/listener    the address of the listener passed to ListenerCreated
+//	/role        the results of Server.IsMaster and IsWorker
+//	/reload-tls  reloads the certificate
+//	/sleep?d=    takes the duration
+//	/hang        never finishes, so the worker can't exit gracefully
+//	/exit        makes the worker exit at once
+//
+// It's configured by the environment variables:
+//
+//	MIYABI_TEST_FD_ENV_KEY          FDEnvKey
+//	MIYABI_TEST_PRE_SHUTDOWN_DELAY  PreShutdownDelay
+//	MIYABI_TEST_STARTUP_DELAY       the delay of the startup
+//	MIYABI_TEST_CRASH               exits as soon as it becomes ready
+//	MIYABI_TEST_TLS_DIR             serves mutual TLS; see writeTLSFiles
+//	MIYABI_TEST_LOG                 logs to stderr
+//
+// SIGQUIT makes the worker exit with status 3 without dumping the
+// goroutines.
+func runWorker() int {
+	if d, err := time.ParseDuration(os.Getenv("MIYABI_TEST_STARTUP_DELAY")); err == nil {
+		time.Sleep(d)
+	}
+	delay, _ := time.ParseDuration(os.Getenv("MIYABI_TEST_PRE_SHUTDOWN_DELAY"))
+	dir := os.Getenv("MIYABI_TEST_TLS_DIR")
+	var created net.Addr
+	var server *miyabi.Server
+	server = &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/reload-tls" {
+				if err := server.ReloadTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			if r.URL.Path == "/cwd" {
+				dir, _ := os.Getwd()
+				io.WriteString(w, dir)
+				return
+			}
+			if r.URL.Path == "/exit" {
+				os.Exit(1)
+			}
+			if r.URL.Path == "/sleep" {
+				d, _ := time.ParseDuration(r.FormValue("d"))
+				w.(http.Flusher).Flush()
+				time.Sleep(d)
+				return
+			}
+			if r.URL.Path == "/hang" {
+				w.(http.Flusher).Flush()
+				select {}
+			}
+			if r.URL.Path == "/extra" {
+				files := miyabi.ExtraFiles()
+				if len(files) == 0 {
+					http.Error(w, "no extra file", http.StatusInternalServerError)
+					return
+				}
+				b := make([]byte, 64)
+				n, _ := files[0].ReadAt(b, 0)
+				fmt.Fprintf(w, "%d %s", files[0].Fd(), b[:n])
+				return
+			}
+			if r.URL.Path == "/exe" {
+				exe, _ := os.Executable()
+				io.WriteString(w, exe)
+				return
+			}
+			if r.URL.Path == "/role" {
+				fmt.Fprintf(w, "master=%v worker=%v", server.IsMaster(), miyabi.IsWorker())
+				return
+			}
+			if r.URL.Path == "/listener" {
+				fmt.Fprint(w, created)
+				return
+			}
+			if r.URL.Path == "/args" {
+				fmt.Fprintf(w, "%s %s", strings.Join(os.Args[1:], " "), os.Getenv("MIYABI_TEST_CHILD_ENV"))
+				return
+			}
+			if r.URL.Path == "/state" {
+				state, err := miyabi.InheritedState()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Write(state)
+				return
+			}
+			fmt.Fprint(w, os.Getpid())
+		})},
+		RestartState: func() []byte {
+			return []byte(strconv.Itoa(os.Getpid()))
+		},
+		ListenerCreated: func(l net.Listener) {
+			created = l.Addr()
+		},
+		HealthPath:       "/healthz",
+		PreShutdownDelay: delay,
+		ProcessTitle:     true,
+		FDEnvKey:         os.Getenv("MIYABI_TEST_FD_ENV_KEY"),
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	go func() {
+		<-quit
+		os.Exit(3)
+	}()
+	if os.Getenv("MIYABI_TEST_CRASH") != "" {
+		go func() {
+			server.WaitReady(context.Background())
+			os.Exit(1)
+		}()
+	}
+	if os.Getenv("MIYABI_TEST_LOG") != "" {
+		server.ErrorLog = log.New(os.Stderr, "", 0)
+	}
+	var err error
+	if dir != "" {
+		// The handshake errors of the clients without certificates are
+		// expected.
+		server.ErrorLog = log.New(io.Discard, "", 0)
+		if server.TLSConfig, err = mutualTLSConfig(dir); err == nil {
+			err = server.ListenAndServeTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+		}
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
 func newTestListener(t *testing.T) net.Listener {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -25,11 +190,126 @@ func newTestListener(t *testing.T) net.Listener {
 	return l
 }
 
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// inheritListener makes the current process look like a forked worker that
+// has inherited the listener l. It returns a function to restore the
+// environment.
+func inheritListener(t *testing.T, l net.Listener) func() {
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := dupFile(t, f)
+	if err := os.Setenv(miyabi.FDEnvKey, strconv.Itoa(fd)); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Unsetenv(miyabi.FDEnvKey)
+	}
+}
+
+// signalSelf sends sig to the current process.
+func signalSelf(t *testing.T, sig os.Signal) {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freeAddr returns a TCP address that is available to listen on.
+func freeAddr(t *testing.T) string {
+	l := newTestListener(t)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitServing waits until a server starts serving on addr and returns the
+// response body.
+func waitServing(t *testing.T, addr string) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get("http://" + addr)
+		if err == nil {
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err == nil {
+				return string(body)
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startMaster runs server.ListenAndServe as a master in the background and
+// waits for StateStart. It returns the channel that receives the subsequent
+// states and the function to shut the server down.
+func startMaster(t *testing.T, server *miyabi.Server) (<-chan miyabi.State, func()) {
+	return startMasterFunc(t, server.ListenAndServe)
+}
+
+// startMasterFunc is like startMaster but runs listenAndServe instead.
+func startMasterFunc(t *testing.T, listenAndServe func() error) (<-chan miyabi.State, func()) {
+	states := make(chan miyabi.State, 10)
+	origServerState := miyabi.ServerState
+	miyabi.ServerState = func(state miyabi.State) {
+		states <- state
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- listenAndServe()
+	}()
+	select {
+	case state := <-states:
+		if state != miyabi.StateStart {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateStart)
+		}
+	case err := <-done:
+		t.Fatalf("ListenAndServe() => %v before start", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return states, func() {
+		defer func() {
+			miyabi.ServerState = origServerState
+		}()
+		signalSelf(t, miyabi.ShutdownSignal)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("timeout")
+		}
+	}
+}
+
 func TestServer_Serve(t *testing.T) {
 	done := make(chan struct{}, 1)
-	server := &miyabi.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		done <- struct{}{}
-	})}
+	})}}
 	l := newTestListener(t)
 	defer l.Close()
 	go func() {
@@ -42,72 +322,2421 @@ func TestServer_Serve(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	select {
-	case <-done:
-	case <-time.After(3 * time.Second):
-		t.Error("timeout")
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("timeout")
+	}
+
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("timeout")
+	}
+}
+
+var registerDefaultMuxOnce sync.Once
+
+func TestServer_Serve_nilHandler(t *testing.T) {
+	registerDefaultMuxOnce.Do(func() {
+		http.HandleFunc("/miyabi-test-default-mux", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "default")
+		})
+	})
+	server := &miyabi.Server{HealthPath: "/healthz"}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/miyabi-test-default-mux", http.StatusOK, "default"},
+		{"/healthz", http.StatusOK, "ok\n"},
+		{"/missing", http.StatusNotFound, "404 page not found\n"},
+	} {
+		res, err := http.Get("http://" + l.Addr().String() + v.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != v.status || string(body) != v.body {
+			t.Errorf("GET %v => %v %q; want %v %q", v.path, res.StatusCode, body, v.status, v.body)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+}
+
+func TestServer_Serve_beforeServe(t *testing.T) {
+	l := newTestListener(t)
+	defer l.Close()
+	var called net.Listener
+	server := &miyabi.Server{BeforeServe: func(l net.Listener) error {
+		called = l
+		return nil
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	if _, err := http.Get("http://" + l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if called != l {
+		t.Errorf("BeforeServe called with %v; want %v", called, l)
+	}
+	l.Close()
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+
+	l = newTestListener(t)
+	defer l.Close()
+	expect := errors.New("not ready")
+	server = &miyabi.Server{BeforeServe: func(l net.Listener) error {
+		return expect
+	}}
+	if err := server.Serve(l); err != expect {
+		t.Errorf("server.Serve(l) => %#v; want %#v", err, expect)
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Errorf("http.Get after BeforeServe failed => nil; want error")
+	}
+}
+
+func TestServer_Serve_gracefulShutdownDefaultSignal(t *testing.T) {
+	testServerServeGracefulShutdown(t)
+}
+
+func TestServer_Serve_gracefulShutdownAnotherSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGHUP, syscall.SIGQUIT} {
+		origSignal := miyabi.ShutdownSignal
+		miyabi.ShutdownSignal = sig
+		defer func() {
+			miyabi.ShutdownSignal = origSignal
+		}()
+		testServerServeGracefulShutdown(t)
+	}
+}
+
+func testServerServeGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+	signalSelf(t, miyabi.ShutdownSignal)
+	close(release)
+	select {
+	case <-server.Done():
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("http.Get => %v; want nil", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Errorf("http.Get after shutdown => nil; want error")
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("server.Shutdown(ctx) before Serve => %v; want nil", err)
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+	go http.Get("http://" + l.Addr().String())
+	<-started
+	expired, cancelExpired := context.WithCancel(context.Background())
+	cancelExpired()
+	if err := server.Shutdown(expired); err != context.Canceled {
+		t.Errorf("server.Shutdown(expired) => %v; want %v", err, context.Canceled)
+	}
+	close(release)
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	select {
+	case <-server.Done():
+	default:
+		t.Error("server.Done() isn't closed after server.Shutdown(ctx)")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+
+	expect := errors.New("not ready")
+	server = &miyabi.Server{BeforeServe: func(l net.Listener) error {
+		return expect
+	}}
+	go server.Serve(newTestListener(t))
+	if err := server.WaitReady(ctx); err != http.ErrServerClosed {
+		t.Errorf("server.WaitReady(ctx) after BeforeServe failed => %v; want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestServer_Wait(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var finished atomic.Bool
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		finished.Store(true)
+	})}}
+	waited := make(chan error, 1)
+	go func() {
+		// Wait is called before Serve.
+		waited <- server.Wait()
+	}()
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go http.Get("http://" + l.Addr().String())
+	<-started
+	go server.Shutdown(ctx)
+	select {
+	case err := <-waited:
+		t.Fatalf("server.Wait() => %v before the request is drained", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("server.Wait() => %v; want nil", err)
+		}
+		if !finished.Load() {
+			t.Error("server.Wait() has returned before the request finished")
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	if err := server.Wait(); err != nil {
+		t.Errorf("server.Wait() after shutdown => %v; want nil", err)
+	}
+
+	expect := errors.New("not ready")
+	server = &miyabi.Server{BeforeServe: func(l net.Listener) error {
+		return expect
+	}}
+	go server.Serve(newTestListener(t))
+	if err := server.Wait(); err != expect {
+		t.Errorf("server.Wait() after BeforeServe failed => %v; want %v", err, expect)
+	}
+}
+
+func TestServer_ServeContext(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})},
+		DrainTimeout: 100 * time.Millisecond,
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeContext(ctx, l)
+	}()
+	if err := server.WaitReady(context.Background()); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+	go http.Get("http://" + l.Addr().String())
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.ServeContext(ctx, l) => %#v; want nil", err)
+		}
+	case <-time.After(server.DrainTimeout + 2*time.Second):
+		t.Fatal("server.ServeContext(ctx, l) hasn't returned within DrainTimeout after ctx is canceled")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener is still open after ctx is canceled")
+	}
+}
+
+func TestServer_ServeMulti(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, "drained")
+	})}}
+	l1, l2 := newTestListener(t), newTestListener(t)
+	defer l1.Close()
+	defer l2.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeMulti(l1, l2)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bodies := make(chan string, 2)
+	for _, l := range []net.Listener{l1, l2} {
+		go func(addr string) {
+			res, err := http.Get("http://" + addr)
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			bodies <- string(b)
+		}(l.Addr().String())
+		select {
+		case <-started:
+		case <-ctx.Done():
+			t.Fatalf("%v doesn't accept", l.Addr())
+		}
+	}
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	for _, l := range []net.Listener{l1, l2} {
+		for {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				break
+			}
+			c.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if actual, expect := <-bodies, "drained"; actual != expect {
+			t.Errorf("response body => %q; want %q", actual, expect)
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.ServeMulti(l1, l2) => %#v; want nil", err)
+	}
+}
+
+type contextKey string
+
+func TestServer_BaseContext(t *testing.T) {
+	values := make(chan [2]interface{}, 1)
+	server := &miyabi.Server{Server: http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			values <- [2]interface{}{ctx.Value(contextKey("base")), ctx.Value(contextKey("conn"))}
+		}),
+		BaseContext: func(l net.Listener) context.Context {
+			return context.WithValue(context.Background(), contextKey("base"), l.Addr().String())
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, contextKey("conn"), c.RemoteAddr().String())
+		},
+	}}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	v := <-values
+	if actual, expect := v[0], l.Addr().String(); actual != expect {
+		t.Errorf("value from BaseContext => %v; want %v", actual, expect)
+	}
+	if v[1] == nil {
+		t.Errorf("value from ConnContext => %v; want the remote address", v[1])
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ConnState(t *testing.T) {
+	states := make(chan http.ConnState, 10)
+	server := &miyabi.Server{Server: http.Server{
+		ConnState: func(c net.Conn, state http.ConnState) {
+			states <- state
+		},
+	}}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := client.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for _, expect := range []http.ConnState{http.StateNew, http.StateActive, http.StateClosed} {
+		select {
+		case actual := <-states:
+			if actual != expect {
+				t.Errorf("ConnState(c, state) => %v; want %v", actual, expect)
+			}
+		case <-ctx.Done():
+			t.Fatalf("ConnState(c, %v) hasn't been called", expect)
+		}
+	}
+	if stats := server.Stats(); stats.Conns != 0 {
+		t.Errorf("server.Stats().Conns => %v; want 0", stats.Conns)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_LongPollPaths(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			select {
+			case <-r.Context().Done():
+				fmt.Fprint(w, context.Cause(r.Context()) == miyabi.ErrDraining)
+			case <-release:
+				fmt.Fprint(w, "released")
+			}
+		})},
+		LongPollPaths: []string{"/poll/*"},
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) <-chan string {
+		ch := make(chan string, 1)
+		go func() {
+			res, err := http.Get("http://" + l.Addr().String() + path)
+			if err != nil {
+				ch <- err.Error()
+				return
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			ch <- string(body)
+		}()
+		return ch
+	}
+	poll, slow := get("/poll/events"), get("/slow")
+	<-started
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	select {
+	case actual := <-poll:
+		if expect := "true"; actual != expect {
+			t.Errorf("long-poll response => %q; want %q", actual, expect)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("long-poll request isn't canceled on draining")
+	}
+	close(release)
+	if actual, expect := <-slow, "released"; actual != expect {
+		t.Errorf("other response => %q; want %q", actual, expect)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+}
+
+func TestServer_Shutdown_master(t *testing.T) {
+	states := make(chan miyabi.State, 10)
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		StateChanged: func(state miyabi.State) {
+			states <- state
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	select {
+	case state := <-states:
+		if state != miyabi.StateStart {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateStart)
+		}
+	case err := <-done:
+		t.Fatalf("ListenAndServe() => %v before start", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	waitServing(t, server.Addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ListenAndServe() => %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("ListenAndServe() hasn't returned after server.Shutdown(ctx)")
+	}
+	if state := <-states; state != miyabi.StateShutdown {
+		t.Errorf("state => %v; want %v", state, miyabi.StateShutdown)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("server.Shutdown(ctx) after shutdown => %v; want nil", err)
+	}
+}
+
+func TestServer_IsMaster(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	if !server.IsMaster() {
+		t.Errorf("server.IsMaster() before ListenAndServe => false; want true")
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	if !server.IsMaster() {
+		t.Errorf("server.IsMaster() in the master => false; want true")
+	}
+	waitServing(t, server.Addr)
+	res, err := http.Get("http://" + server.Addr + "/role")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, expect := string(body), "master=false worker=true"; actual != expect {
+		t.Errorf("role of the worker => %q; want %q", actual, expect)
+	}
+}
+
+// optionalInterfaces returns the names of the optional interfaces of
+// http.ResponseWriter that w implements.
+func optionalInterfaces(w http.ResponseWriter) string {
+	var names []string
+	if _, ok := w.(http.Flusher); ok {
+		names = append(names, "Flusher")
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		names = append(names, "Hijacker")
+	}
+	if _, ok := w.(http.Pusher); ok {
+		names = append(names, "Pusher")
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		names = append(names, "ReaderFrom")
+	}
+	return strings.Join(names, " ")
+}
+
+func TestServer_Serve_responseWriterInterfaces(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, optionalInterfaces(w))
+	})}}
+	l := newTestListener(t)
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ServeContext(ctx, l)
+	if err := server.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ResponseWriter of HTTP/1.x doesn't implement http.Pusher.
+	if actual, expect := string(body), "Flusher Hijacker ReaderFrom"; actual != expect {
+		t.Errorf("optional interfaces of ResponseWriter => %q; want %q", actual, expect)
+	}
+}
+
+func TestServer_ShutdownChan(t *testing.T) {
+	shutdownChan := make(chan struct{})
+	server := &miyabi.Server{ShutdownChan: shutdownChan}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+	close(shutdownChan)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server.Serve(l) hasn't returned after ShutdownChan is closed")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener is still open after ShutdownChan is closed")
+	}
+	// The shutdown by ShutdownChan has already taken effect.
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("server.Shutdown(ctx) after ShutdownChan is closed => %v; want nil", err)
+	}
+}
+
+func TestServer_ShutdownChan_master(t *testing.T) {
+	states := make(chan miyabi.State, 10)
+	shutdownChan := make(chan struct{})
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		StateChanged: func(state miyabi.State) {
+			states <- state
+		},
+		ShutdownChan: shutdownChan,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	select {
+	case state := <-states:
+		if state != miyabi.StateStart {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateStart)
+		}
+	case err := <-done:
+		t.Fatalf("ListenAndServe() => %v before start", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	waitServing(t, server.Addr)
+	close(shutdownChan)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ListenAndServe() => %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() hasn't returned after ShutdownChan is closed")
+	}
+	if state := <-states; state != miyabi.StateShutdown {
+		t.Errorf("state => %v; want %v", state, miyabi.StateShutdown)
+	}
+	if _, err := http.Get("http://" + server.Addr); err == nil {
+		t.Error("http.Get after ShutdownChan is closed => nil; want error")
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("server.Shutdown(ctx) after ShutdownChan is closed => %v; want nil", err)
+	}
+}
+
+func TestServer_Restart(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	if err := server.Restart(); err != miyabi.ErrNotMaster {
+		t.Errorf("server.Restart() before ListenAndServe => %v; want %v", err, miyabi.ErrNotMaster)
+	}
+	states, stop := startMaster(t, server)
+	pid := waitServing(t, server.Addr)
+	if err := server.Restart(); err != nil {
+		t.Fatalf("server.Restart() => %v; want nil", err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+	stop()
+	if err := server.Restart(); err != miyabi.ErrNotMaster {
+		t.Errorf("server.Restart() after shutdown => %v; want %v", err, miyabi.ErrNotMaster)
+	}
+}
+
+func TestServer_BoundAddr(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Addr: "127.0.0.1:0"}}
+	if addr := server.BoundAddr(); addr != nil {
+		t.Errorf("server.BoundAddr() before ListenAndServe => %v; want nil", addr)
+	}
+	_, stop := startMaster(t, server)
+	addr, ok := server.BoundAddr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("server.BoundAddr() => %v; want the address with non-zero port", server.BoundAddr())
+	}
+	waitServing(t, addr.String())
+	stop()
+	if addr := server.BoundAddr(); addr != nil {
+		t.Errorf("server.BoundAddr() after shutdown => %v; want nil", addr)
+	}
+
+	server = &miyabi.Server{}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if actual, expect := server.BoundAddr(), l.Addr(); actual != expect {
+		t.Errorf("server.BoundAddr() => %v; want %v", actual, expect)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_WorkerPid(t *testing.T) {
+	type stateAndPid struct {
+		state miyabi.State
+		pid   int
+	}
+	var server *miyabi.Server
+	pids := make(chan stateAndPid, 10)
+	server = &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		StateChanged: func(state miyabi.State) {
+			pids <- stateAndPid{state, server.WorkerPid()}
+			miyabi.ServerState(state)
+		},
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	for _, expect := range []miyabi.State{miyabi.StateStart, miyabi.StateRestart} {
+		if expect == miyabi.StateRestart {
+			if err := server.Restart(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-states:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+		}
+		actual := <-pids
+		if actual.state != expect {
+			t.Fatalf("state => %v; want %v", actual.state, expect)
+		}
+		if pid := waitServing(t, server.Addr); strconv.Itoa(actual.pid) != pid {
+			t.Errorf("server.WorkerPid() on %v => %v; want %v", expect, actual.pid, pid)
+		}
+	}
+}
+
+func TestServer_ListenAndServe_respawn(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server:             http.Server{Addr: freeAddr(t)},
+		Logger:             log.New(&buf, "", 0),
+		MinRestartInterval: 10 * time.Millisecond,
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	// A request on a reused connection would be retried on the respawned
+	// worker.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if _, err := client.Get("http://" + server.Addr + "/exit"); err == nil {
+		t.Fatal("GET /exit => nil; want error")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.WorkerPid() == 0 || strconv.Itoa(server.WorkerPid()) == pid {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker %v hasn't been respawned; log => %q", pid, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if actual, expect := waitServing(t, server.Addr), strconv.Itoa(server.WorkerPid()); actual != expect {
+		t.Errorf("respawned worker pid => %v; want %v", actual, expect)
+	}
+	if expect := fmt.Sprintf("worker %s exited unexpectedly", pid); !strings.Contains(buf.String(), expect) {
+		t.Errorf("log => %q; want to contain %q", buf.String(), expect)
+	}
+}
+
+func TestServer_ListenAndServeContext_respawnAfterStartup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	server := &miyabi.Server{
+		Server:             http.Server{Addr: freeAddr(t)},
+		MinRestartInterval: 10 * time.Millisecond,
+	}
+	_, stop := startMasterFunc(t, func() error {
+		return server.ListenAndServeContext(ctx)
+	})
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	// The worker crashes after ctx has expired.
+	<-ctx.Done()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if _, err := client.Get("http://" + server.Addr + "/exit"); err == nil {
+		t.Fatal("GET /exit => nil; want error")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.WorkerPid() == 0 || strconv.Itoa(server.WorkerPid()) == pid {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker %v hasn't been respawned after the startup context has expired", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if actual, expect := waitServing(t, server.Addr), strconv.Itoa(server.WorkerPid()); actual != expect {
+		t.Errorf("respawned worker pid => %v; want %v", actual, expect)
+	}
+}
+
+func TestServer_ListenAndServe_workerKilled(t *testing.T) {
+	server := &miyabi.Server{
+		Server:             http.Server{Addr: freeAddr(t)},
+		MinRestartInterval: 10 * time.Millisecond,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	p, err := os.FindProcess(server.WorkerPid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateWorkerExited {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateWorkerExited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		actual := waitServing(t, server.Addr)
+		if actual != pid && actual == strconv.Itoa(server.WorkerPid()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("worker pid => %v; want a replacement of %v", actual, pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ListenAndServe_crashLoop(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server:             http.Server{Addr: freeAddr(t)},
+		Logger:             log.New(&buf, "", 0),
+		ChildEnv:           append(os.Environ(), "MIYABI_TEST_CRASH=1"),
+		MaxRestarts:        3,
+		MinRestartInterval: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, miyabi.ErrCrashLoop) {
+			t.Errorf("ListenAndServe() => %v; want %v", err, miyabi.ErrCrashLoop)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout; log => %q", buf.String())
+	}
+	if actual, expect := strings.Count(buf.String(), "exited unexpectedly"), 4; actual != expect {
+		t.Errorf("unexpected exits => %v; want %v", actual, expect)
+	}
+	// Each of 3 respawns waits for MinRestartInterval since the previous
+	// start.
+	if elapsed, expect := time.Since(start), 3*server.MinRestartInterval; elapsed < expect {
+		t.Errorf("ListenAndServe() returned in %v; want at least %v", elapsed, expect)
+	}
+	if pid := server.WorkerPid(); pid != 0 {
+		t.Errorf("server.WorkerPid() => %v; want 0", pid)
+	}
+}
+
+func TestServer_ListenAndServe_shutdownWhileRespawning(t *testing.T) {
+	var buf syncBuffer
+	states := make(chan miyabi.State, 10)
+	shutdownChan := make(chan struct{})
+	server := &miyabi.Server{
+		Server:             http.Server{Addr: freeAddr(t)},
+		Logger:             log.New(&buf, "", 0),
+		ChildEnv:           append(os.Environ(), "MIYABI_TEST_CRASH=1"),
+		MinRestartInterval: 10 * time.Second,
+		ShutdownChan:       shutdownChan,
+		StateChanged: func(state miyabi.State) {
+			states <- state
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	for state := range states {
+		if state == miyabi.StateWorkerExited {
+			break
+		}
+	}
+	start := time.Now()
+	close(shutdownChan)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ListenAndServe() => %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe() hasn't returned while waiting to respawn; log => %q", buf.String())
+	}
+	if elapsed := time.Since(start); elapsed >= server.MinRestartInterval {
+		t.Errorf("ListenAndServe() returned in %v; want less than %v", elapsed, server.MinRestartInterval)
+	}
+	if strings.Contains(buf.String(), "respawned worker") {
+		t.Errorf("log => %q; want no respawn after shutdown", buf.String())
+	}
+}
+
+func TestServer_Restart_failed(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	// The new worker can't be started in the missing directory.
+	server.WorkingDir = filepath.Join(t.TempDir(), "missing")
+	if err := server.Restart(); err != nil {
+		t.Fatalf("server.Restart() => %v; want nil", err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestartFailed {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestartFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual != pid {
+		t.Errorf("worker pid => %v after failed restart; want %v", actual, pid)
+	}
+}
+
+func TestServer_ExecutablePath(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "miyabi.test")
+	if err := os.WriteFile(path, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	server := &miyabi.Server{
+		Server:         http.Server{Addr: freeAddr(t)},
+		ExecutablePath: path,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	if actual := waitServing(t, server.Addr+"/exe"); actual != path {
+		t.Errorf("executable of the worker => %q; want %q", actual, path)
+	}
+	pid := waitServing(t, server.Addr)
+	// The worker keeps running on the removed binary, but can't be
+	// restarted from it.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Restart(); err != nil {
+		t.Fatalf("server.Restart() => %v; want nil", err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestartFailed {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestartFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual != pid {
+		t.Errorf("worker pid => %v after failed restart; want %v", actual, pid)
+	}
+}
+
+func TestServer_Logger_restart(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		Logger: log.New(&buf, "", 0),
+	}
+	states, stop := startMaster(t, server)
+	pid := waitServing(t, server.Addr)
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	newPID := waitServing(t, server.Addr)
+	stop()
+	for _, expect := range []string{
+		fmt.Sprintf("miyabi: started worker %s on %s\n", pid, server.Addr),
+		fmt.Sprintf("miyabi: restarting worker %s\n", pid),
+		fmt.Sprintf("miyabi: restarted, worker %s replaced %s\n", newPID, pid),
+		fmt.Sprintf("miyabi: shutting down worker %s\n", newPID),
+		"miyabi: shut down\n",
+	} {
+		if actual := buf.String(); !strings.Contains(actual, expect) {
+			t.Errorf("logged %q; want to contain %q", actual, expect)
+		}
+	}
+}
+
+func TestServer_OnForceKill(t *testing.T) {
+	killed := make(chan int, 1)
+	server := &miyabi.Server{
+		Server:  http.Server{Addr: freeAddr(t)},
+		Timeout: 200 * time.Millisecond,
+		OnForceKill: func(pid int) {
+			killed <- pid
+		},
+	}
+	states, stop := startMaster(t, server)
+	pid := waitServing(t, server.Addr)
+	res, err := http.Get("http://" + server.Addr + "/hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	start := time.Now()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case actual := <-killed:
+		if expect := pid; strconv.Itoa(actual) != expect {
+			t.Errorf("OnForceKill(pid) => %v; want %v", actual, expect)
+		}
+		if elapsed := time.Since(start); elapsed < server.Timeout {
+			t.Errorf("OnForceKill(pid) has been called in %v; want after %v", elapsed, server.Timeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if state := <-states; state != miyabi.StateRestart {
+		t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+	}
+	waitServing(t, server.Addr)
+	stop()
+
+	// The worker that exits gracefully isn't reported. Timeout is long
+	// enough for the exit under the race detector.
+	killed = make(chan int, 1)
+	server = &miyabi.Server{
+		Server:  http.Server{Addr: freeAddr(t)},
+		Timeout: 10 * time.Second,
+		OnForceKill: func(pid int) {
+			killed <- pid
+		},
+	}
+	_, stop = startMaster(t, server)
+	waitServing(t, server.Addr)
+	stop()
+	select {
+	case pid := <-killed:
+		t.Errorf("OnForceKill(%v) has been called on graceful shutdown", pid)
+	default:
+	}
+}
+
+func TestServer_FDEnvKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var servers [2]*miyabi.Server
+	var states [2]chan miyabi.State
+	var done [2]chan error
+	var pids [2]string
+	for i, key := range []string{"MIYABI_TEST_A_FD", "MIYABI_TEST_B_FD"} {
+		states[i], done[i] = make(chan miyabi.State, 10), make(chan error, 1)
+		state := states[i]
+		servers[i] = &miyabi.Server{
+			Server:   http.Server{Addr: freeAddr(t)},
+			FDEnvKey: key,
+			ChildEnv: append(os.Environ(), "MIYABI_TEST_FD_ENV_KEY="+key),
+			StateChanged: func(s miyabi.State) {
+				state <- s
+			},
+		}
+		go func(server *miyabi.Server, done chan<- error) {
+			done <- server.ListenAndServe()
+		}(servers[i], done[i])
+		if state := <-states[i]; state != miyabi.StateStart {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateStart)
+		}
+		pids[i] = waitServing(t, servers[i].Addr)
+	}
+	for i, server := range servers {
+		if err := server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case state := <-states[i]:
+			if state != miyabi.StateRestart {
+				t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		for j, other := range servers {
+			pid := waitServing(t, other.Addr)
+			if restarted := pid != pids[j]; restarted != (i == j) {
+				t.Errorf("worker of server %d restarted => %v after server %d restarted; want %v", j, restarted, i, i == j)
+			}
+			pids[j] = pid
+		}
+	}
+	for i, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+		}
+		if err := <-done[i]; err != nil {
+			t.Errorf("server.ListenAndServe() => %v; want nil", err)
+		}
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func TestServer_RegisterCloser(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{Logger: log.New(&buf, "", 0)}
+	var order []int
+	errs := []error{errors.New("close error 1"), nil, errors.New("close error 3")}
+	for i, err := range errs {
+		i, err := i+1, err
+		server.RegisterCloser(closerFunc(func() error {
+			order = append(order, i)
+			return err
+		}))
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := <-done
+	for _, expect := range []error{errs[0], errs[2]} {
+		if !errors.Is(err, expect) {
+			t.Errorf("server.Serve(l) => %v; want to contain %v", err, expect)
+		}
+	}
+	if expect := []int{3, 2, 1}; !reflect.DeepEqual(order, expect) {
+		t.Errorf("closed in %v; want %v", order, expect)
+	}
+	if actual, expect := buf.String(), "2 of 3 closers failed to close"; !strings.Contains(actual, expect) {
+		t.Errorf("logged %q; want to contain %q", actual, expect)
+	}
+}
+
+// getStatus returns the status code of GET url, or 0 if it fails.
+func getStatus(url string) int {
+	res, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestServer_LBSafeShutdown(t *testing.T) {
+	server := &miyabi.Server{
+		LBSafeShutdown:   true,
+		PreShutdownDelay: 300 * time.Millisecond,
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String() + "/healthz"
+	if actual, expect := getStatus(url), http.StatusOK; actual != expect {
+		t.Errorf("GET /healthz => %v; want %v", actual, expect)
+	}
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	for getStatus(url) != http.StatusServiceUnavailable {
+		if time.Since(start) > server.PreShutdownDelay {
+			t.Fatal("GET /healthz didn't respond with 503 during PreShutdownDelay")
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed < server.PreShutdownDelay {
+		t.Errorf("shutdown took %v; want at least %v", elapsed, server.PreShutdownDelay)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+
+	var buf syncBuffer
+	server = &miyabi.Server{
+		LBSafeShutdown: true,
+		Logger:         log.New(&buf, "", 0),
+	}
+	server.LogConfig()
+	for _, expect := range []string{`health_path="/healthz"`, "pre_shutdown_delay=15s", "drain_timeout=30s"} {
+		if actual := buf.String(); !strings.Contains(actual, expect) {
+			t.Errorf("LogConfig() logged %q; want to contain %q", actual, expect)
+		}
+	}
+}
+
+func TestServer_KubernetesShutdown(t *testing.T) {
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		})},
+		KubernetesShutdown: true,
+		PreShutdownDelay:   300 * time.Millisecond,
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *http.Response {
+		res, err := http.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := get("/"); res.Close {
+		t.Errorf("GET / before shutdown => Connection: close; want keep-alive")
+	}
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	for get("/healthz").StatusCode != http.StatusServiceUnavailable {
+		if time.Since(start) > server.PreShutdownDelay {
+			t.Fatal("GET /healthz didn't respond with 503 during PreShutdownDelay")
+		}
+	}
+	if res := get("/"); !res.Close || res.StatusCode != http.StatusOK {
+		t.Errorf("GET / during PreShutdownDelay => %v, close=%v; want %v, close=true", res.StatusCode, res.Close, http.StatusOK)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+
+	var buf syncBuffer
+	server = &miyabi.Server{
+		KubernetesShutdown: true,
+		Logger:             log.New(&buf, "", 0),
+	}
+	server.LogConfig()
+	for _, expect := range []string{`health_path="/healthz"`, "pre_shutdown_delay=5s", "drain_timeout=20s"} {
+		if actual := buf.String(); !strings.Contains(actual, expect) {
+			t.Errorf("LogConfig() logged %q; want to contain %q", actual, expect)
+		}
+	}
+}
+
+func TestServer_HealthPath(t *testing.T) {
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})},
+		HealthPath:       "/ready",
+		PreShutdownDelay: 300 * time.Millisecond,
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + l.Addr().String()
+	for _, v := range []struct {
+		path   string
+		expect int
+	}{
+		{"/ready", http.StatusOK},
+		{"/healthz", http.StatusTeapot},
+		{"/", http.StatusTeapot},
+	} {
+		if actual := getStatus(base + v.path); actual != v.expect {
+			t.Errorf("GET %v before shutdown => %v; want %v", v.path, actual, v.expect)
+		}
+	}
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	for getStatus(base+"/ready") != http.StatusServiceUnavailable {
+		if time.Since(start) > server.PreShutdownDelay {
+			t.Fatal("GET /ready didn't respond with 503 during PreShutdownDelay")
+		}
+	}
+	if actual, expect := getStatus(base+"/"), http.StatusTeapot; actual != expect {
+		t.Errorf("GET / during PreShutdownDelay => %v; want %v", actual, expect)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed < server.PreShutdownDelay {
+		t.Errorf("shutdown took %v; want at least %v", elapsed, server.PreShutdownDelay)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+}
+
+func TestServer_PostListenCloseDelay(t *testing.T) {
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		})},
+		PostListenCloseDelay: 300 * time.Millisecond,
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func() *http.Response {
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+	get()
+	start := time.Now()
+	go server.Shutdown(ctx)
+	for {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			break
+		}
+		c.Close()
+		if ctx.Err() != nil {
+			t.Fatal("timeout")
+		}
+	}
+	if res := get(); res.StatusCode != http.StatusOK || res.Close {
+		t.Errorf("GET / during PostListenCloseDelay => %v, close=%v; want %v, close=false", res.StatusCode, res.Close, http.StatusOK)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	if elapsed := time.Since(start); elapsed < server.PostListenCloseDelay {
+		t.Errorf("shutdown took %v; want at least %v", elapsed, server.PostListenCloseDelay)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("reading the idle connection after draining => %v; want %v", err, io.EOF)
+	}
+}
+
+func TestServer_ListenAndServe_preShutdownDelay(t *testing.T) {
+	const delay = 2 * time.Second
+	os.Setenv("MIYABI_TEST_PRE_SHUTDOWN_DELAY", delay.String())
+	defer os.Unsetenv("MIYABI_TEST_PRE_SHUTDOWN_DELAY")
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		// Don't let the race detector delay the exit of the old worker.
+		ChildEnv: append(os.Environ(), "GORACE=atexit_sleep_ms=0"),
+	}
+	states, stop := startMaster(t, server)
+	waitServing(t, server.Addr)
+	url := "http://" + server.Addr + "/healthz"
+	if actual, expect := getStatus(url), http.StatusOK; actual != expect {
+		t.Errorf("GET /healthz => %v; want %v", actual, expect)
+	}
+	start := time.Now()
+	signalSelf(t, miyabi.RestartSignal)
+	select {
+	case <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= delay/4 {
+		t.Errorf("restart took %v; want PreShutdownDelay not to be applied", elapsed)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	unhealthy := false
+	for !unhealthy {
+		select {
+		case <-stopped:
+			t.Fatal("GET /healthz didn't respond with 503 before shutdown")
+		default:
+		}
+		unhealthy = getStatus(url) == http.StatusServiceUnavailable
+	}
+	<-stopped
+}
+
+func TestServer_ListenAndServe_inheritedAddrMismatch(t *testing.T) {
+	for _, v := range []struct {
+		addr   func(l net.Listener) string
+		expect bool
+	}{
+		{func(l net.Listener) string { return l.Addr().String() }, false},
+		{func(l net.Listener) string { return "127.0.0.1:0" }, false},
+		{func(l net.Listener) string { return "127.0.0.1:1" }, true},
+	} {
+		func() {
+			l := newTestListener(t)
+			defer l.Close()
+			defer inheritListener(t, l)()
+			var buf syncBuffer
+			server := &miyabi.Server{Server: http.Server{
+				Addr:     v.addr(l),
+				ErrorLog: log.New(&buf, "", 0),
+			}}
+			done := make(chan error, 1)
+			go func() {
+				done <- server.ListenAndServe()
+			}()
+			if _, err := http.Get("http://" + l.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+			p, err := os.FindProcess(os.Getpid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Signal(miyabi.ShutdownSignal); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("ListenAndServe() => %#v; want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+			actual := strings.Contains(buf.String(), "differs from the inherited listener address")
+			if actual != v.expect {
+				t.Errorf("Addr %q; warning logged => %v; want %v", server.Addr, actual, v.expect)
+			}
+		}()
+	}
+}
+
+func TestServer_ListenAndServe_listenerName(t *testing.T) {
+	for _, v := range []struct {
+		name   string
+		expect string
+	}{
+		{"", "listen socket 127.0.0.1:1"},
+		{"api", "listen socket api"},
+	} {
+		func() {
+			// A regular file can't be a listener.
+			f, err := os.CreateTemp(t.TempDir(), "miyabi")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			os.Setenv(miyabi.FDEnvKey, strconv.Itoa(dupFile(t, f)))
+			defer os.Unsetenv(miyabi.FDEnvKey)
+			server := &miyabi.Server{
+				Server:       http.Server{Addr: "127.0.0.1:1"},
+				ListenerName: v.name,
+			}
+			err = server.ListenAndServe()
+			if err == nil || !strings.Contains(err.Error(), v.expect) {
+				t.Errorf("ListenerName %q; ListenAndServe() => %v; want error containing %q", v.name, err, v.expect)
+			}
+		}()
+	}
+}
+
+func TestServer_ListenAndServe_listenerCreated(t *testing.T) {
+	created := make(chan string, 1)
+	server := &miyabi.Server{
+		Server: http.Server{Addr: "127.0.0.1:0"},
+		ListenerCreated: func(l net.Listener) {
+			created <- l.Addr().String()
+		},
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	var addr string
+	select {
+	case addr = <-created:
+	default:
+		t.Fatal("ListenerCreated isn't called before StateStart")
+	}
+	if strings.HasSuffix(addr, ":0") {
+		t.Fatalf("ListenerCreated called with %v; want the bound port", addr)
+	}
+	waitServing(t, addr)
+	res, err := http.Get("http://" + addr + "/listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(body); actual != addr {
+		t.Errorf("ListenerCreated in the worker called with %v; want %v", actual, addr)
+	}
+}
+
+func TestServer_NumActiveConns(t *testing.T) {
+	const n = 3
+	started := make(chan struct{}, n)
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	})}}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Read the counter concurrently with the connections opening and
+	// closing, which is checked by the race detector.
+	stop := make(chan struct{})
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if n := server.NumActiveConns(); n < 0 {
+					t.Errorf("server.NumActiveConns() => %v; want non-negative", n)
+				}
+			}
+		}
+	}()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := client.Get("http://" + l.Addr().String()); err == nil {
+				res.Body.Close()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := client.Get("http://" + l.Addr().String() + "/slow"); err == nil {
+				res.Body.Close()
+			}
+		}()
+		<-started
+	}
+	// The connections of the other requests may not be closed yet.
+	for deadline := time.Now().Add(5 * time.Second); server.NumActiveConns() != n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("server.NumActiveConns() => %v; want %v", server.NumActiveConns(), n)
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(stop)
+	<-reading
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if actual, expect := server.NumActiveConns(), 0; actual != expect {
+		t.Errorf("server.NumActiveConns() after shutdown => %v; want %v", actual, expect)
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	})}}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 3; i++ {
+		res, err := client.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	result := make(chan error, 1)
+	go func() {
+		res, err := client.Get("http://" + l.Addr().String() + "/slow")
+		if err == nil {
+			res.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+	// The connections of the served requests may not be closed yet.
+	stats := server.Stats()
+	if actual, expect := stats, (miyabi.Stats{Requests: 3, InFlightRequests: 1, Conns: stats.Conns, ActiveConns: 1}); actual != expect {
+		t.Errorf("server.Stats() => %+v; want %+v", actual, expect)
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats = server.Stats()
+	if actual, expect := stats, (miyabi.Stats{Requests: 4, Conns: stats.Conns}); actual != expect {
+		t.Errorf("server.Stats() after shutdown => %+v; want %+v", actual, expect)
+	}
+}
+
+func TestServer_OnDrain(t *testing.T) {
+	const n = 3
+	started := make(chan struct{}, n)
+	release := make(chan struct{}, 1)
+	counts := make(chan int, n+1)
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		})},
+		OnDrain: func(remaining int) {
+			counts <- remaining
+		},
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < n; i++ {
+		go func() {
+			if res, err := client.Get("http://" + l.Addr().String()); err == nil {
+				res.Body.Close()
+			}
+		}()
+		<-started
+	}
+	go server.Shutdown(ctx)
+	for expect := n; expect >= 0; expect-- {
+		select {
+		case actual := <-counts:
+			if actual != expect {
+				t.Errorf("OnDrain(remaining) => %v; want %v", actual, expect)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		if expect > 0 {
+			// Finish one request at a time to keep the order of the counts.
+			release <- struct{}{}
+		}
+	}
+	select {
+	case <-server.Done():
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestServer_OnShutdownStart(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	l := newTestListener(t)
+	defer l.Close()
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			record("request")
+		})},
+		OnShutdownStart: func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Errorf("net.Dial in OnShutdownStart => %v; want the listener to be open", err)
+			} else {
+				conn.Close()
+			}
+			record("start")
+			close(release)
+		},
+		OnShutdownComplete: func() {
+			record("complete")
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	go func() {
+		if res, err := client.Get("http://" + l.Addr().String()); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+	mu.Lock()
+	actual := events
+	mu.Unlock()
+	if expect := []string{"start", "request", "complete"}; !reflect.DeepEqual(actual, expect) {
+		t.Errorf("events => %q; want %q", actual, expect)
+	}
+}
+
+func TestServer_OnShutdownStart_panic(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Logger: log.New(&buf, "", 0),
+		OnShutdownStart: func() {
+			panic("start")
+		},
+		OnShutdownComplete: func() {
+			panic("complete")
+		},
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+	for _, expect := range []string{"OnShutdownStart panicked: start", "OnShutdownComplete panicked: complete"} {
+		if actual := buf.String(); !strings.Contains(actual, expect) {
+			t.Errorf("log => %q; want to contain %q", actual, expect)
+		}
+	}
+}
+
+func TestServer_Serve_drainDecision(t *testing.T) {
+	started := make(chan struct{}, 2)
+	block := make(chan struct{})
+	defer close(block)
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			switch r.URL.Path {
+			case "/keep":
+				time.Sleep(500 * time.Millisecond)
+				io.WriteString(w, "kept")
+			case "/cut":
+				<-block
+			}
+		})},
+		DrainTimeout:     100 * time.Millisecond,
+		DrainHardTimeout: 5 * time.Second,
+		DrainDecision: func(r *http.Request) bool {
+			return r.URL.Path == "/keep"
+		},
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	results := make(map[string]chan error)
+	for _, path := range []string{"/keep", "/cut"} {
+		result := make(chan error, 1)
+		results[path] = result
+		go func(path string) {
+			res, err := http.Get("http://" + l.Addr().String() + path)
+			if err == nil {
+				_, err = io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			result <- err
+		}(path)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	signalSelf(t, miyabi.ShutdownSignal)
+	for path, expect := range map[string]bool{"/keep": true, "/cut": false} {
+		select {
+		case err := <-results[path]:
+			if actual := err == nil; actual != expect {
+				t.Errorf("GET %v => %v; want success %v", path, err, expect)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GET %v: timeout", path)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout")
+	}
+}
+
+func TestServer_Serve_truncatedResponses(t *testing.T) {
+	started := make(chan struct{}, 2)
+	block := make(chan struct{})
+	defer close(block)
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/partial" {
+				w.Header().Set("Content-Length", "10")
+				io.WriteString(w, "part")
+				w.(http.Flusher).Flush()
+			}
+			started <- struct{}{}
+			<-block
+		})},
+		DrainTimeout: 100 * time.Millisecond,
+		Logger:       log.New(&buf, "", 0),
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/partial", "/silent"} {
+		go http.Get("http://" + l.Addr().String() + path)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if actual, expect := server.Stats().TruncatedResponses, uint64(1); actual != expect {
+		t.Errorf("Stats().TruncatedResponses => %v; want %v", actual, expect)
+	}
+	for _, expect := range []string{
+		"truncated the response to GET /partial from ",
+		"closed 2 connections forcibly, 1 responses were truncated",
+	} {
+		if actual := buf.String(); !strings.Contains(actual, expect) {
+			t.Errorf("logged %q; want to contain %q", actual, expect)
+		}
+	}
+}
+
+func TestServer_Serve_drainTimeout(t *testing.T) {
+	var buf syncBuffer
+	const n = 3
+	started := make(chan struct{}, n)
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			select {}
+		})},
+		DrainTimeout: 100 * time.Millisecond,
+		Logger:       log.New(&buf, "", 0),
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	for i := 0; i < n; i++ {
+		go http.Get("http://" + l.Addr().String())
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	start := time.Now()
+	signalSelf(t, miyabi.ShutdownSignal)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server.Serve(l) hasn't returned with the hung handlers")
+	}
+	if actual, max := time.Since(start), server.DrainTimeout+time.Second; actual > max {
+		t.Errorf("drain took %v; want at most %v", actual, max)
+	}
+	if actual, expect := buf.String(), "closed 3 connections forcibly"; !strings.Contains(actual, expect) {
+		t.Errorf("logged %q; want to contain %q", actual, expect)
+	}
+}
+
+func TestServer_Serve_drainTimeoutPerConn(t *testing.T) {
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-block
+		})},
+		DrainTimeout:        50 * time.Millisecond,
+		DrainTimeoutPerConn: time.Hour,
+		DrainMaxTimeout:     500 * time.Millisecond,
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	go http.Get("http://" + l.Addr().String())
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	start := time.Now()
+	signalSelf(t, miyabi.ShutdownSignal)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual, min := time.Since(start), 400*time.Millisecond; actual < min {
+		t.Errorf("drain took %v; want at least %v", actual, min)
+	}
+}
+
+func TestServer_Serve_drainIdleTimeout(t *testing.T) {
+	server := &miyabi.Server{DrainIdleTimeout: 200 * time.Millisecond}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	waitServing(t, l.Addr().String())
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	signalSelf(t, miyabi.ShutdownSignal)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %v; want about %v", elapsed, server.DrainIdleTimeout)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the idle connection => %v; want %v", err, io.EOF)
+	}
+}
+
+func TestServer_Serve_drainIdleKeepAlive(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	})}}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	waitServing(t, l.Addr().String())
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	br := bufio.NewReader(idle)
+	io.WriteString(idle, "GET / HTTP/1.1\r\nHost: miyabi\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	go http.Get("http://" + l.Addr().String() + "/slow")
+	<-started
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("server.Shutdown(ctx) => %v; want %v", err, context.DeadlineExceeded)
+	}
+	// The idle connection is closed while the active one is being drained.
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("read from the idle keep-alive connection => %v; want %v", err, io.EOF)
+	}
+	select {
+	case err := <-done:
+		t.Errorf("server.Serve(l) => %v before the active request finishes; want draining", err)
+	default:
+	}
+}
+
+func TestServer_Serve_drainPipelinedRequests(t *testing.T) {
+	dir := t.TempDir()
+	writeTLSFiles(t, dir, newTestCertificate(t), newTestCertificate(t))
+	for _, useTLS := range []bool{false, true} {
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		server := &miyabi.Server{Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/first" {
+				started <- struct{}{}
+				<-release
+			}
+			io.WriteString(w, r.URL.Path)
+		})}}
+		l := newTestListener(t)
+		defer l.Close()
+		done := make(chan error, 1)
+		go func() {
+			if useTLS {
+				done <- server.ServeTLS(l, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+			} else {
+				done <- server.Serve(l)
+			}
+		}()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if useTLS {
+			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+		if _, err := io.WriteString(conn, "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\nGET /second HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+		signalSelf(t, miyabi.ShutdownSignal)
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		for _, expect := range []string{"/first", "/second"} {
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("TLS %v: read response for %v => %v; want nil", useTLS, expect, err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := string(body); actual != expect {
+				t.Errorf("TLS %v: response body => %q; want %q", useTLS, actual, expect)
+			}
+		}
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf("TLS %v: read after pipelined responses => %v; want %v", useTLS, err, io.EOF)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("TLS %v: server.Serve(l) => %#v; want nil", useTLS, err)
+			}
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func TestServer_Serve_minReadRate(t *testing.T) {
+	var buf syncBuffer
+	server := &miyabi.Server{MinReadRate: 100}
+	server.Logger = log.New(&buf, "", 0)
+	l := newTestListener(t)
+	defer l.Close()
+	go server.Serve(l)
+	waitServing(t, l.Addr().String())
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closed := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+	start := time.Now()
+	header := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+loop:
+	for i := 0; i < len(header); i++ {
+		if _, err := io.WriteString(conn, header[i:i+1]); err != nil {
+			break
+		}
+		select {
+		case <-closed:
+			break loop
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
-
-	l.Close()
-	select {
-	case <-done:
-	case <-time.After(3 * time.Second):
-		t.Error("timeout")
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("slow connection was closed after %v; want within %v", elapsed, 3*time.Second)
 	}
+	if actual, expect := buf.String(), "closing slow connection"; !strings.Contains(actual, expect) {
+		t.Errorf("log => %q; want to contain %q", actual, expect)
+	}
+	waitServing(t, l.Addr().String())
 }
 
-func TestServer_Serve_gracefulShutdownDefaultSignal(t *testing.T) {
-	testServerServeGracefulShutdown(t)
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails Accept with err, or temporaryError if nil, n times
+// before accepting.
+type flakyListener struct {
+	net.Listener
+
+	n   int32
+	err error
 }
 
-func TestServer_Serve_gracefulShutdownAnotherSignal(t *testing.T) {
-	for _, sig := range []syscall.Signal{syscall.SIGHUP, syscall.SIGQUIT} {
-		origSignal := miyabi.ShutdownSignal
-		miyabi.ShutdownSignal = sig
-		defer func() {
-			miyabi.ShutdownSignal = origSignal
-		}()
-		testServerServeGracefulShutdown(t)
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.n, -1) >= 0 {
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, temporaryError{}
 	}
+	return l.Listener.Accept()
 }
 
-func testServerServeGracefulShutdown(t *testing.T) {
-	done := make(chan struct{})
-	server := &miyabi.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		done <- struct{}{}
-	})}
-	l := newTestListener(t)
+type testBackoff struct {
+	mu     sync.Mutex
+	next   int
+	resets int
+}
+
+func (b *testBackoff) Next() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next++
+	return time.Millisecond
+}
+
+func (b *testBackoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resets++
+}
+
+func TestServer_Serve_acceptBackoff(t *testing.T) {
+	backoff := &testBackoff{}
+	server := &miyabi.Server{AcceptBackoff: backoff}
+	l := &flakyListener{Listener: newTestListener(t), n: 3}
 	defer l.Close()
-	go server.Serve(l)
-	wait := make(chan struct{})
+	done := make(chan error, 1)
 	go func() {
-		if _, err := http.Get("http://" + l.Addr().String()); err != nil {
-			t.Errorf("http.Get => %v; want nil", err)
-		}
-		wait <- struct{}{}
+		done <- server.Serve(l)
 	}()
-	<-time.After(1 * time.Second)
-	pid := os.Getpid()
-	p, err := os.FindProcess(pid)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
 		t.Fatal(err)
 	}
-	if err := p.Signal(miyabi.ShutdownSignal); err != nil {
+	if actual, expect := getStatus("http://"+l.Addr().String()), http.StatusNotFound; actual != expect {
+		t.Errorf("GET / => %v; want %v", actual, expect)
+	}
+	backoff.mu.Lock()
+	next, resets := backoff.next, backoff.resets
+	backoff.mu.Unlock()
+	if expect := 3; next != expect {
+		t.Errorf("AcceptBackoff.Next() called %v times; want %v", next, expect)
+	}
+	if resets < 1 {
+		t.Errorf("AcceptBackoff.Reset() called %v times; want at least 1", resets)
+	}
+	if err := server.Shutdown(ctx); err != nil {
 		t.Fatal(err)
 	}
-	go func() {
-		<-time.After(1 * time.Second)
-		if _, err = http.Get("http://" + l.Addr().String()); err == nil {
-			t.Errorf("http.Get after shutdown => nil; want error")
+	if err := <-done; err != nil {
+		t.Errorf("server.Serve(l) => %#v; want nil", err)
+	}
+}
+
+func TestServer_Serve_acceptErrors(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	for _, v := range []struct {
+		err       error
+		temporary bool
+	}{
+		{emfile, true},
+		{fmt.Errorf("wrapped: %w", emfile), true},
+		{errors.New("permanent error"), false},
+	} {
+		server := &miyabi.Server{AcceptBackoff: &testBackoff{}}
+		l := &flakyListener{Listener: newTestListener(t), n: 1, err: v.err}
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Serve(l)
+		}()
+		if !v.temporary {
+			select {
+			case err := <-done:
+				if err != v.err {
+					t.Errorf("server.Serve(l) with %v => %v; want %v", v.err, err, v.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("server.Serve(l) with %v hasn't returned", v.err)
+			}
+			l.Close()
+			continue
 		}
-		<-done
-		<-wait
-		wait <- struct{}{}
-	}()
-	select {
-	case <-wait:
-	case <-time.After(5 * time.Second):
-		t.Errorf("timeout")
+		if actual, expect := getStatus("http://"+l.Addr().String()), http.StatusNotFound; actual != expect {
+			t.Errorf("GET / after %v => %v; want %v", v.err, actual, expect)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := server.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("server.Serve(l) after %v => %#v; want nil", v.err, err)
+		}
+		l.Close()
 	}
 }
 
@@ -123,14 +2752,57 @@ func TestServerState_StateStart(t *testing.T) {
 	defer func() {
 		miyabi.ServerState = origServerState
 	}()
-	go miyabi.ListenAndServe(addr, nil)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- miyabi.ListenAndServe(addr, nil)
+	}()
 	select {
 	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	signalSelf(t, miyabi.ShutdownSignal)
+	select {
+	case <-stopped:
 	case <-time.After(5 * time.Second):
 		t.Errorf("timeout")
 	}
 }
 
+func TestServerState_StateReady(t *testing.T) {
+	l := newTestListener(t)
+	defer l.Close()
+	states := make(chan miyabi.State, 1)
+	server := &miyabi.Server{StateChanged: func(state miyabi.State) {
+		states <- state
+	}}
+	go server.Serve(l)
+	select {
+	case state := <-states:
+		if state != miyabi.StateReady {
+			t.Errorf("state => %v; want %v", state, miyabi.StateReady)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	// The server accepts connections once StateReady is fired.
+	res, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		t.Errorf("state => %v after shutdown in the serving process; want no state", state)
+	default:
+	}
+}
+
 func TestServerState_StateShutdown(t *testing.T) {
 	done := make(chan struct{})
 	started := make(chan struct{})
@@ -167,15 +2839,484 @@ func TestServerState_StateShutdown(t *testing.T) {
 	}
 }
 
+func TestServer_BlockRestarts(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	server.BlockRestarts()
+	for i := 0; i < 3; i++ {
+		signalSelf(t, miyabi.RestartSignal)
+	}
+	select {
+	case state := <-states:
+		t.Fatalf("state => %v while restarts are blocked; want no state change", state)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if actual := waitServing(t, server.Addr); actual != pid {
+		t.Errorf("worker pid => %v while restarts are blocked; want %v", actual, pid)
+	}
+	server.UnblockRestarts()
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case state := <-states:
+		t.Errorf("state => %v; want a single restart", state)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+}
+
+func TestServer_CanRestartNow(t *testing.T) {
+	var inWindow, calls int32
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		CanRestartNow: func() bool {
+			atomic.AddInt32(&calls, 1)
+			return atomic.LoadInt32(&inWindow) != 0
+		},
+		RestartRetryInterval: 50 * time.Millisecond,
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	signalSelf(t, miyabi.RestartSignal)
+	select {
+	case state := <-states:
+		t.Fatalf("state => %v out of the window; want no state change", state)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if actual := atomic.LoadInt32(&calls); actual < 2 {
+		t.Errorf("CanRestartNow called %v times; want retries", actual)
+	}
+	atomic.StoreInt32(&inWindow, 1)
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+}
+
+func TestServer_OnPromote(t *testing.T) {
+	type promotion struct {
+		oldPID, newPID string
+	}
+	promoted := make(chan promotion, 1)
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	server.OnPromote = func(oldPID, newPID int) {
+		// The new worker is ready and the old worker is still running at
+		// this point.
+		promoted <- promotion{strconv.Itoa(oldPID), strconv.Itoa(newPID)}
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	signalSelf(t, miyabi.RestartSignal)
+	var p promotion
+	select {
+	case p = <-promoted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if state := <-states; state != miyabi.StateRestart {
+		t.Errorf("state after promotion => %v; want %v", state, miyabi.StateRestart)
+	}
+	if p.oldPID != pid {
+		t.Errorf("OnPromote oldPID => %v; want %v", p.oldPID, pid)
+	}
+	if actual := waitServing(t, server.Addr); p.newPID != actual {
+		t.Errorf("OnPromote newPID => %v; want %v", p.newPID, actual)
+	}
+}
+
+func TestServer_WaitForDependencies(t *testing.T) {
+	called := false
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		WaitForDependencies: func(ctx context.Context) error {
+			called = true
+			if _, ok := ctx.Deadline(); ok {
+				t.Errorf("WaitForDependencies called with deadline; want no deadline")
+			}
+			return nil
+		},
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	waitServing(t, server.Addr)
+	if !called {
+		t.Errorf("WaitForDependencies isn't called")
+	}
+
+	addr := freeAddr(t)
+	server = &miyabi.Server{
+		Server: http.Server{Addr: addr},
+		WaitForDependencies: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		DependenciesTimeout: 100 * time.Millisecond,
+	}
+	if err := server.ListenAndServe(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("server.ListenAndServe() => %v; want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := http.Get("http://" + addr); err == nil {
+		t.Errorf("http.Get after WaitForDependencies failed => nil; want error")
+	}
+}
+
+func TestServer_ShutdownMarkerFile(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "shutdown")
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := &miyabi.Server{
+		Server:             http.Server{Addr: freeAddr(t)},
+		ShutdownMarkerFile: marker,
+	}
+	_, stop := startMaster(t, server)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(marker) after start => %v; want not exist", err)
+	}
+	stop()
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("os.Stat(marker) after shutdown => %v; want nil", err)
+	}
+}
+
+func TestServer_PidFile(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "miyabi.pid")
+	// Leave a stale PID file as if the previous master has crashed.
+	if err := os.WriteFile(pidFile, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := &miyabi.Server{
+		Server:  http.Server{Addr: freeAddr(t)},
+		PidFile: pidFile,
+	}
+	_, stop := startMaster(t, server)
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	if actual, expect := string(b), fmt.Sprintf("%d\n", os.Getpid()); actual != expect {
+		t.Errorf("PID file => %q; want %q", actual, expect)
+	}
+	stop()
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(pidFile) after shutdown => %v; want not exist", err)
+	}
+}
+
+func TestServer_Network(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is unavailable: %v", err)
+	} else {
+		l.Close()
+	}
+	for _, v := range []struct {
+		network   string
+		reusePort bool
+		serving   string
+		refused   string
+	}{
+		{"tcp4", false, "127.0.0.1", "::1"},
+		{"tcp6", false, "::1", "127.0.0.1"},
+		{"tcp4", true, "127.0.0.1", "::1"},
+		{"tcp6", true, "::1", "127.0.0.1"},
+	} {
+		func() {
+			_, port, err := net.SplitHostPort(freeAddr(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &miyabi.Server{
+				Server:    http.Server{Addr: ":" + port},
+				Network:   v.network,
+				ReusePort: v.reusePort,
+			}
+			_, stop := startMaster(t, server)
+			defer stop()
+			waitServing(t, net.JoinHostPort(v.serving, port))
+			if c, err := net.Dial("tcp", net.JoinHostPort(v.refused, port)); err == nil {
+				c.Close()
+				t.Errorf("Network %v, ReusePort %v: net.Dial to %v => nil; want error", v.network, v.reusePort, v.refused)
+			}
+		}()
+	}
+}
+
+func TestServer_WorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	server := &miyabi.Server{
+		Server:     http.Server{Addr: freeAddr(t)},
+		WorkingDir: dir,
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	if actual := waitServing(t, server.Addr+"/cwd"); actual != dir {
+		t.Errorf("working directory of the worker => %q; want %q", actual, dir)
+	}
+}
+
+func TestServer_ChildArgs(t *testing.T) {
+	server := &miyabi.Server{
+		Server:    http.Server{Addr: freeAddr(t)},
+		ChildArgs: []string{"-reloaded"},
+		ChildEnv:  append(os.Environ(), "MIYABI_TEST_CHILD_ENV=rotated"),
+	}
+	_, stop := startMaster(t, server)
+	defer stop()
+	waitServing(t, server.Addr)
+	if actual, expect := waitServing(t, server.Addr+"/args"), "-reloaded rotated"; actual != expect {
+		t.Errorf("worker args and env => %q; want %q", actual, expect)
+	}
+}
+
+func TestServer_ExtraFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extra")
+	if err := os.WriteFile(path, []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	server := &miyabi.Server{
+		Server:     http.Server{Addr: freeAddr(t)},
+		ExtraFiles: []*os.File{f},
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	if actual, expect := waitServing(t, server.Addr+"/extra"), "8 extra"; actual != expect {
+		t.Errorf("extra file in the worker => %q; want %q", actual, expect)
+	}
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual, expect := waitServing(t, server.Addr+"/extra"), "8 extra"; actual != expect {
+		t.Errorf("extra file in the worker after restart => %q; want %q", actual, expect)
+	}
+	if files := miyabi.ExtraFiles(); files != nil {
+		t.Errorf("miyabi.ExtraFiles() in the master => %v; want nil", files)
+	}
+}
+
+func TestServer_ListenAndServe_removedWorkingDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	dir, err := os.MkdirTemp("", "miyabi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Getwd(); err == nil {
+		t.Skip("os.Getwd() succeeds in the removed directory")
+	}
+	var buf syncBuffer
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		Logger: log.New(&buf, "", 0),
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	signalSelf(t, miyabi.RestartSignal)
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+	if actual, expect := waitServing(t, server.Addr+"/cwd"), filepath.Dir(os.Args[0]); actual != expect {
+		t.Errorf("working directory of the worker => %q; want %q", actual, expect)
+	}
+	if expect := "the worker runs in " + filepath.Dir(os.Args[0]); !strings.Contains(buf.String(), expect) {
+		t.Errorf("logged %q; want to contain %q", buf.String(), expect)
+	}
+}
+
+func TestServer_ListenAndServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	origServerState := miyabi.ServerState
+	defer func() {
+		miyabi.ServerState = origServerState
+	}()
+	states := make(chan miyabi.State, 10)
+	miyabi.ServerState = func(state miyabi.State) {
+		states <- state
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServeContext(ctx)
+	}()
+	select {
+	case <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	// ctx doesn't affect the server after the startup.
+	cancel()
+	waitServing(t, server.Addr)
+	signalSelf(t, miyabi.ShutdownSignal)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.ListenAndServeContext(ctx) => %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	os.Setenv("MIYABI_TEST_STARTUP_DELAY", "5s")
+	defer os.Unsetenv("MIYABI_TEST_STARTUP_DELAY")
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	server = &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	start := time.Now()
+	if err := server.ListenAndServeContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("server.ListenAndServeContext(ctx) => %v; want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("startup took %v; want to be aborted at the deadline", elapsed)
+	}
+	if _, err := http.Get("http://" + server.Addr); err == nil {
+		t.Errorf("http.Get after the startup is aborted => nil; want error")
+	}
+}
+
+func TestServer_RestartState(t *testing.T) {
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	if actual := waitServing(t, server.Addr+"/state"); actual != "" {
+		t.Errorf("InheritedState() in the first worker => %q; want empty", actual)
+	}
+	signalSelf(t, miyabi.RestartSignal)
+	select {
+	case <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual, expect := waitServing(t, server.Addr+"/state"), pid; actual != expect {
+		t.Errorf("InheritedState() => %q; want %q", actual, expect)
+	}
+}
+
+func TestServer_HealthCheckURL(t *testing.T) {
+	for _, v := range []struct {
+		url    func(addr string) string
+		expect bool
+	}{
+		{func(addr string) string { return "http://" + addr }, false},
+		{func(addr string) string { return "http://" + freeAddr(t) }, true},
+	} {
+		func() {
+			addr := freeAddr(t)
+			server := &miyabi.Server{
+				Server:             http.Server{Addr: addr},
+				HealthCheckURL:     v.url(addr),
+				HealthCheckTimeout: 300 * time.Millisecond,
+			}
+			states, stop := startMaster(t, server)
+			defer stop()
+			waitServing(t, addr)
+			signalSelf(t, miyabi.RestartSignal)
+			if state := <-states; state != miyabi.StateRestart {
+				t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+			}
+			var actual bool
+			select {
+			case state := <-states:
+				actual = state == miyabi.StateRestartUnhealthy
+			case <-time.After(time.Second):
+			}
+			if actual != v.expect {
+				t.Errorf("HealthCheckURL %v; %v fired => %v; want %v", server.HealthCheckURL, miyabi.StateRestartUnhealthy, actual, v.expect)
+			}
+		}()
+	}
+}
+
+func TestServer_HTTPServer(t *testing.T) {
+	errorLog := log.New(io.Discard, "", 0)
+	server := &miyabi.Server{Server: http.Server{
+		Addr:           "127.0.0.1:8080",
+		ReadTimeout:    time.Second,
+		MaxHeaderBytes: 1024,
+		ErrorLog:       errorLog,
+	}}
+	hs := server.HTTPServer()
+	if hs != &server.Server {
+		t.Fatalf("server.HTTPServer() => %p; want %p", hs, &server.Server)
+	}
+	for _, v := range []struct {
+		name           string
+		actual, expect interface{}
+	}{
+		{"Addr", hs.Addr, "127.0.0.1:8080"},
+		{"ReadTimeout", hs.ReadTimeout, time.Second},
+		{"MaxHeaderBytes", hs.MaxHeaderBytes, 1024},
+		{"ErrorLog", hs.ErrorLog, errorLog},
+	} {
+		if !reflect.DeepEqual(v.actual, v.expect) {
+			t.Errorf("server.HTTPServer().%s => %v; want %v", v.name, v.actual, v.expect)
+		}
+	}
+	hs.WriteTimeout = 2 * time.Second
+	if actual, expect := server.WriteTimeout, 2*time.Second; actual != expect {
+		t.Errorf("server.WriteTimeout => %v after setting through HTTPServer(); want %v", actual, expect)
+	}
+}
+
 func TestIsMaster(t *testing.T) {
 	origEnv := make([]string, len(os.Environ()))
 	copy(origEnv, os.Environ())
+	server := &miyabi.Server{FDEnvKey: "MIYABI_TEST_FD"}
 	for _, v := range []struct {
-		env    string
-		expect bool
+		env          string
+		expect       bool
+		expectServer bool
 	}{
-		{miyabi.FDEnvKey, false},
-		{"UNKNOWN_KEY", true},
+		{miyabi.FDEnvKey, false, true},
+		{server.FDEnvKey, true, false},
+		{"UNKNOWN_KEY", true, true},
 	} {
 		func() {
 			defer func() {
@@ -194,6 +3335,12 @@ func TestIsMaster(t *testing.T) {
 			if !reflect.DeepEqual(actual, expect) {
 				t.Errorf(`IsMaster() with %v=1 => %#v; want %#v`, v.env, actual, expect)
 			}
+			if actual, expect := miyabi.IsWorker(), !v.expect; actual != expect {
+				t.Errorf(`IsWorker() with %v=1 => %#v; want %#v`, v.env, actual, expect)
+			}
+			if actual, expect := server.IsMaster(), v.expectServer; actual != expect {
+				t.Errorf(`server.IsMaster() with FDEnvKey %q and %v=1 => %#v; want %#v`, server.FDEnvKey, v.env, actual, expect)
+			}
 		}()
 	}
 }
@@ -0,0 +1,63 @@
+package miyabi_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_ListenAndServe_windows(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &miyabi.Server{Server: http.Server{
+		Addr: freeAddr(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "drained")
+		}),
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatalf("server.WaitReady(ctx) => %v; want nil", err)
+	}
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + server.Addr)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if actual, expect := <-body, "drained"; actual != expect {
+		t.Errorf("response body => %q; want %q", actual, expect)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.ListenAndServe() => %#v; want nil", err)
+	}
+	if err := server.Restart(); err != miyabi.ErrNotMaster {
+		t.Errorf("server.Restart() => %v; want %v", err, miyabi.ErrNotMaster)
+	}
+}
@@ -0,0 +1,192 @@
+package miyabi
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	shutdownNoticeOnce sync.Once
+	shutdownNoticeChan chan struct{}
+)
+
+// shutdown shuts down the server serving on l. If delay is true, HealthPath
+// reports unhealthy and the server keeps serving for PreShutdownDelay before
+// the listener is closed, and draining is left to Serve to start after
+// PostListenCloseDelay. If force is true, the connections are closed
+// without draining.
+func (srv *Server) shutdown(l net.Listener, delay, force bool) {
+	if atomic.CompareAndSwapInt32(&srv.shuttingDown, 0, 1) {
+		srv.callHook("OnShutdownStart", srv.OnShutdownStart)
+	}
+	if d := srv.preShutdownDelay(); delay && !force && d > 0 {
+		srv.logf("miyabi: waiting %v before closing the listener", d)
+		time.Sleep(d)
+	}
+	if delay && !force && srv.PostListenCloseDelay > 0 {
+		atomic.StoreInt32(&srv.drainDeferred, 1)
+		l.Close()
+		return
+	}
+	srv.startDrain()
+	if force {
+		atomic.StoreInt32(&srv.forceShutdown, 1)
+	}
+	l.Close()
+}
+
+// callHook calls f unless it's nil. A panic in f is logged and recovered,
+// so that it doesn't stop the shutdown sequence.
+func (srv *Server) callHook(name string, f func()) {
+	if f == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			srv.logf("miyabi: %s panicked: %v", name, err)
+		}
+	}()
+	f()
+}
+
+// healthPath returns HealthPath, or its default if LBSafeShutdown or
+// KubernetesShutdown is enabled.
+func (srv *Server) healthPath() string {
+	if srv.HealthPath == "" && (srv.LBSafeShutdown || srv.KubernetesShutdown) {
+		return lbSafeHealthPath
+	}
+	return srv.HealthPath
+}
+
+// preShutdownDelay returns PreShutdownDelay, or its default if
+// LBSafeShutdown or KubernetesShutdown is enabled.
+func (srv *Server) preShutdownDelay() time.Duration {
+	if srv.PreShutdownDelay == 0 && srv.LBSafeShutdown {
+		return lbSafePreShutdownDelay
+	}
+	if srv.PreShutdownDelay == 0 && srv.KubernetesShutdown {
+		return k8sPreShutdownDelay
+	}
+	return srv.PreShutdownDelay
+}
+
+// serveHealth responds to the request to HealthPath.
+func (srv *Server) serveHealth(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if atomic.LoadInt32(&srv.shuttingDown) != 0 {
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "shutting down\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// shutdownNotice returns a channel that is closed when the master notifies
+// the worker of the final shutdown. It returns nil if the current process
+// isn't a worker.
+func shutdownNotice() <-chan struct{} {
+	shutdownNoticeOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(shutdownFDEnvKey))
+		if err != nil {
+			return
+		}
+		shutdownNoticeChan = make(chan struct{})
+		f := os.NewFile(uintptr(fd), "shutdown pipe")
+		go func() {
+			defer f.Close()
+			if _, err := f.Read(make([]byte, 1)); err == nil {
+				close(shutdownNoticeChan)
+			}
+		}()
+	})
+	return shutdownNoticeChan
+}
+
+// shutdownWorker notifies the worker p of the final shutdown and waits for
+// it to exit. p will be killed if it doesn't exit within PreShutdownDelay,
+// PostListenCloseDelay and Timeout. If p can't be notified, it's stopped by ShutdownSignal.
+func (srv *Server) shutdownWorker(p *worker) error {
+	_, err := p.shutdown.Write([]byte{1})
+	p.shutdown.Close()
+	if err != nil {
+		return srv.stopProcess(p)
+	}
+	timeout := srv.timeout()
+	if timeout > 0 {
+		timeout += srv.preShutdownDelay() + srv.PostListenCloseDelay
+	}
+	return srv.waitOrKill(p, timeout)
+}
+
+// removeShutdownMarker removes ShutdownMarkerFile left by the previous run.
+func (srv *Server) removeShutdownMarker() error {
+	if srv.ShutdownMarkerFile == "" {
+		return nil
+	}
+	if err := os.Remove(srv.ShutdownMarkerFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// touchShutdownMarker creates ShutdownMarkerFile, or updates its
+// modification time if it exists.
+func (srv *Server) touchShutdownMarker() error {
+	if srv.ShutdownMarkerFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(srv.ShutdownMarkerFile, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(srv.ShutdownMarkerFile, now, now)
+}
+
+// RegisterCloser registers c to be closed on shutdown after the connections
+// are drained, which is a convenience to release the resources such as files
+// and clients. The registered closers are closed in the reverse order of the
+// registration to respect the dependencies between them, when Serve returns
+// in the worker and when ListenAndServe and ListenAndServeTLS return in the
+// master. Note that each process closes its own closers registered by the
+// program running in it.
+//
+// The errors of Close are logged, and returned joined by errors.Join from
+// Serve, ListenAndServe or ListenAndServeTLS unless they fail by themselves.
+func (srv *Server) RegisterCloser(c io.Closer) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closers = append(srv.closers, c)
+}
+
+// closeClosers closes and unregisters the closers registered by
+// RegisterCloser in the reverse order. It returns the joined errors.
+func (srv *Server) closeClosers() error {
+	srv.mu.Lock()
+	closers := srv.closers
+	srv.closers = nil
+	srv.mu.Unlock()
+	var errs []error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	err := errors.Join(errs...)
+	srv.logf("miyabi: %d of %d closers failed to close: %v", len(errs), len(closers), err)
+	return err
+}
@@ -0,0 +1,149 @@
+package miyabi
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// An Action represents the action that the server takes when it receives
+// a signal. It's used by Server.Signals.
+type Action uint8
+
+const (
+	// ActionShutdown shuts down the server gracefully.
+	ActionShutdown Action = iota
+
+	// ActionRestart restarts the server gracefully.
+	ActionRestart
+
+	// ActionForceShutdown shuts down the server immediately without waiting
+	// for the active connections.
+	ActionForceShutdown
+
+	// ActionIgnore ignores the signal.
+	ActionIgnore
+
+	// ActionRebind closes the listener and opens a new one on Server.Addr,
+	// and then restarts the worker gracefully on the new listener. It's
+	// taken by the master of ListenAndServe and ListenAndServeTLS only.
+	ActionRebind
+)
+
+// An Escalation is a step of Server.EscalationSignals, which sends Signal to
+// the old worker that hasn't exited for After.
+type Escalation struct {
+	After  time.Duration
+	Signal os.Signal
+}
+
+// signalActions returns the actions for the signals.
+func (srv *Server) signalActions() map[os.Signal]Action {
+	if srv.Signals != nil {
+		return srv.Signals
+	}
+	// ShutdownSignal is set last so that shutdown takes precedence if it's
+	// the same signal as RestartSignal.
+	actions := make(map[os.Signal]Action)
+	actions[srv.restartSignal()] = ActionRestart
+	for _, sig := range srv.RestartSignals {
+		actions[sig] = ActionRestart
+	}
+	if !srv.IgnoreSIGINT {
+		actions[syscall.SIGINT] = ActionShutdown
+	}
+	actions[srv.shutdownSignal()] = ActionShutdown
+	for _, sig := range srv.ShutdownSignals {
+		actions[sig] = ActionShutdown
+	}
+	return actions
+}
+
+// notify causes the signals in actions to be relayed to c.
+// If filter is not nil, only the signals of the actions for which filter
+// reports true are relayed.
+func notify(c chan<- os.Signal, actions map[os.Signal]Action, filter func(action Action) bool) {
+	var sigs []os.Signal
+	for sig, action := range actions {
+		if filter == nil || filter(action) {
+			sigs = append(sigs, sig)
+		}
+	}
+	// signal.Notify relays all signals if no signal is given.
+	if len(sigs) > 0 {
+		signal.Notify(c, sigs...)
+	}
+}
+
+// controlCommands maps the commands written to Server.ControlFIFO to the
+// actions.
+var controlCommands = map[string]Action{
+	"shutdown":       ActionShutdown,
+	"restart":        ActionRestart,
+	"force-shutdown": ActionForceShutdown,
+	"rebind":         ActionRebind,
+}
+
+// startWaitSignals starts waiting for the signals to shut down the server
+// serving on l. Unless the current process is a worker, it also watches
+// ControlFIFO and ShutdownChan. It returns the function to stop waiting.
+func (srv *Server) startWaitSignals(l net.Listener) (stop func(), err error) {
+	var commands <-chan Action
+	stopFIFO := func() {}
+	if srv.IsMaster() {
+		if commands, stopFIFO, err = srv.watchControlFIFO(); err != nil {
+			return nil, err
+		}
+	}
+	actions := srv.signalActions()
+	if !srv.IsMaster() {
+		workerActions := make(map[os.Signal]Action, len(actions)+1)
+		for sig, action := range actions {
+			workerActions[sig] = action
+		}
+		workerActions[srv.shutdownSignal()] = ActionShutdown
+		actions = workerActions
+	}
+	c := make(chan os.Signal, max(len(actions), 1))
+	notify(c, actions, func(action Action) bool {
+		return action != ActionRestart && action != ActionRebind
+	})
+	var shutdownChan <-chan struct{}
+	if srv.IsMaster() {
+		shutdownChan = srv.ShutdownChan
+	}
+	quit := make(chan struct{})
+	go func() {
+		defer signal.Stop(c)
+		for {
+			action := ActionIgnore
+			select {
+			case sig := <-c:
+				action = actions[sig]
+			case action = <-commands:
+			case <-shutdownNotice():
+				srv.shutdown(l, true, false)
+				return
+			case <-shutdownChan:
+				srv.shutdown(l, true, false)
+				return
+			case <-quit:
+				return
+			}
+			switch action {
+			case ActionShutdown, ActionForceShutdown:
+				// In a worker, ShutdownSignal is sent by the master on
+				// graceful restart. The final shutdown is notified by
+				// shutdownNotice instead.
+				srv.shutdown(l, action == ActionShutdown && srv.IsMaster(), action == ActionForceShutdown)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		stopFIFO()
+	}, nil
+}
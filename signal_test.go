@@ -0,0 +1,383 @@
+//go:build !windows
+// +build !windows
+
+package miyabi_test
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_Serve_signals(t *testing.T) {
+	server := &miyabi.Server{Signals: map[os.Signal]miyabi.Action{
+		syscall.SIGUSR1: miyabi.ActionShutdown,
+		syscall.SIGUSR2: miyabi.ActionIgnore,
+	}}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	waitServing(t, l.Addr().String())
+	signalSelf(t, syscall.SIGUSR2)
+	select {
+	case err := <-done:
+		t.Fatalf("server.Serve(l) => %v by ignored signal; want keep serving", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	waitServing(t, l.Addr().String())
+	signalSelf(t, syscall.SIGUSR1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServer_Serve_signalsForceShutdown(t *testing.T) {
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+	server := &miyabi.Server{
+		Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-block
+		})},
+		Signals: map[os.Signal]miyabi.Action{
+			syscall.SIGUSR1: miyabi.ActionForceShutdown,
+		},
+	}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	result := make(chan error, 1)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+	signalSelf(t, syscall.SIGUSR1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if err := <-result; err == nil {
+		t.Errorf("http.Get with force shutdown => nil; want error")
+	}
+}
+
+func TestServer_IgnoreSIGINT(t *testing.T) {
+	// The program owns SIGINT instead of the server.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT)
+	defer signal.Stop(c)
+	server := &miyabi.Server{IgnoreSIGINT: true}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	waitServing(t, l.Addr().String())
+	signalSelf(t, syscall.SIGINT)
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("server.Serve(l) => %v by SIGINT; want keep serving", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	waitServing(t, l.Addr().String())
+	signalSelf(t, miyabi.ShutdownSignal)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServer_ListenAndServe_signals(t *testing.T) {
+	server := &miyabi.Server{
+		Server: http.Server{Addr: freeAddr(t)},
+		Signals: map[os.Signal]miyabi.Action{
+			syscall.SIGUSR1:       miyabi.ActionRestart,
+			miyabi.ShutdownSignal: miyabi.ActionShutdown,
+		},
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	signalSelf(t, syscall.SIGUSR1)
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+}
+
+func TestServer_ShutdownSignal_perServer(t *testing.T) {
+	servers := map[os.Signal]*miyabi.Server{
+		syscall.SIGUSR1: {ShutdownSignal: syscall.SIGUSR1},
+		syscall.SIGUSR2: {ShutdownSignal: syscall.SIGUSR2},
+	}
+	dones := make(map[os.Signal]chan error)
+	for sig, server := range servers {
+		l := newTestListener(t)
+		defer l.Close()
+		done := make(chan error, 1)
+		dones[sig] = done
+		go func(server *miyabi.Server) {
+			done <- server.Serve(l)
+		}(server)
+		waitServing(t, l.Addr().String())
+	}
+	signalSelf(t, syscall.SIGUSR1)
+	select {
+	case err := <-dones[syscall.SIGUSR1]:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case err := <-dones[syscall.SIGUSR2]:
+		t.Fatalf("server.Serve(l) with another ShutdownSignal => %v; want keep serving", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	signalSelf(t, syscall.SIGUSR2)
+	select {
+	case err := <-dones[syscall.SIGUSR2]:
+		if err != nil {
+			t.Errorf("server.Serve(l) => %#v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServer_ShutdownSignals(t *testing.T) {
+	for _, sig := range []os.Signal{syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2} {
+		server := &miyabi.Server{ShutdownSignals: []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}}
+		l := newTestListener(t)
+		defer l.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Serve(l)
+		}()
+		waitServing(t, l.Addr().String())
+		signalSelf(t, sig)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%v: server.Serve(l) => %#v; want nil", sig, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: timeout", sig)
+		}
+	}
+}
+
+func TestServer_RestartSignals(t *testing.T) {
+	server := &miyabi.Server{
+		Server:         http.Server{Addr: freeAddr(t)},
+		RestartSignals: []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2},
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	for _, sig := range []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2} {
+		signalSelf(t, sig)
+		select {
+		case state := <-states:
+			if state != miyabi.StateRestart {
+				t.Errorf("%v: state => %v; want %v", sig, state, miyabi.StateRestart)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: timeout", sig)
+		}
+		actual := waitServing(t, server.Addr)
+		if actual == pid {
+			t.Errorf("%v: worker pid => %v; want a new one", sig, actual)
+		}
+		pid = actual
+	}
+}
+
+func TestServer_ListenAndServe_signalsDuringRestart(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	server := &miyabi.Server{
+		Server:   http.Server{Addr: freeAddr(t)},
+		ChildEnv: append(os.Environ(), "MIYABI_TEST_STARTUP_DELAY="+delay.String()),
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	// The second signal arrives while the master is waiting for the new
+	// worker of the first one.
+	signalSelf(t, miyabi.RestartSignal)
+	time.Sleep(delay / 3)
+	signalSelf(t, miyabi.RestartSignal)
+	for i := 0; i < 2; i++ {
+		select {
+		case state := <-states:
+			if state != miyabi.StateRestart {
+				t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("restarted %v times; want 2", i)
+		}
+	}
+	if actual := waitServing(t, server.Addr); actual == pid {
+		t.Errorf("worker pid => %v; want a new one", actual)
+	}
+}
+
+func TestServer_StateChanged(t *testing.T) {
+	origServerState := miyabi.ServerState
+	defer func() {
+		miyabi.ServerState = origServerState
+	}()
+	global := make(chan miyabi.State, 10)
+	miyabi.ServerState = func(state miyabi.State) {
+		global <- state
+	}
+	servers := map[os.Signal]*miyabi.Server{
+		syscall.SIGUSR1: {Server: http.Server{Addr: freeAddr(t)}, RestartSignal: syscall.SIGUSR1},
+		syscall.SIGUSR2: {Server: http.Server{Addr: freeAddr(t)}, RestartSignal: syscall.SIGUSR2},
+	}
+	states := make(map[os.Signal]chan miyabi.State)
+	dones := make(map[os.Signal]chan error)
+	for sig, server := range servers {
+		ch := make(chan miyabi.State, 10)
+		states[sig] = ch
+		server.StateChanged = func(state miyabi.State) {
+			ch <- state
+		}
+		done := make(chan error, 1)
+		dones[sig] = done
+		go func(server *miyabi.Server) {
+			done <- server.ListenAndServe()
+		}(server)
+	}
+	expectState := func(sig os.Signal, expect miyabi.State) {
+		select {
+		case state := <-states[sig]:
+			if state != expect {
+				t.Errorf("state of the server with RestartSignal %v => %v; want %v", sig, state, expect)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("state of the server with RestartSignal %v: timeout", sig)
+		}
+	}
+	for sig := range servers {
+		expectState(sig, miyabi.StateStart)
+	}
+	signalSelf(t, syscall.SIGUSR1)
+	expectState(syscall.SIGUSR1, miyabi.StateRestart)
+	select {
+	case state := <-states[syscall.SIGUSR2]:
+		t.Errorf("state of another server => %v; want no change", state)
+	case <-time.After(300 * time.Millisecond):
+	}
+	signalSelf(t, miyabi.ShutdownSignal)
+	for sig := range servers {
+		expectState(sig, miyabi.StateShutdown)
+		select {
+		case <-dones[sig]:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	select {
+	case state := <-global:
+		t.Errorf("ServerState called with %v; want StateChanged to be called instead", state)
+	default:
+	}
+}
+
+func TestServer_EscalationSignals(t *testing.T) {
+	var buf syncBuffer
+	killed := make(chan int, 1)
+	server := &miyabi.Server{
+		Server:  http.Server{Addr: freeAddr(t)},
+		Logger:  log.New(&buf, "", 0),
+		Timeout: 5 * time.Second,
+		EscalationSignals: []miyabi.Escalation{
+			{After: 200 * time.Millisecond, Signal: syscall.SIGQUIT},
+			{After: 500 * time.Millisecond, Signal: syscall.SIGQUIT},
+			{After: 10 * time.Second, Signal: syscall.SIGQUIT},
+		},
+		OnForceKill: func(pid int) {
+			killed <- pid
+		},
+	}
+	states, stop := startMaster(t, server)
+	defer stop()
+	pid := waitServing(t, server.Addr)
+	res, err := http.Get("http://" + server.Addr + "/hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	start := time.Now()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	// The worker exits on the first SIGQUIT.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed >= 500*time.Millisecond {
+		t.Errorf("restart took %v; want between 200ms and 500ms", elapsed)
+	}
+	time.Sleep(500 * time.Millisecond)
+	expect := "worker " + pid + " hasn't exited for 200ms, sending quit"
+	if actual := buf.String(); strings.Count(actual, "sending") != 1 || !strings.Contains(actual, expect) {
+		t.Errorf("log => %q; want to contain %q only", actual, expect)
+	}
+	select {
+	case pid := <-killed:
+		t.Errorf("OnForceKill(%v) has been called; want the worker to exit by SIGQUIT", pid)
+	default:
+	}
+}
@@ -4,9 +4,9 @@ package miyabi
 
 import "fmt"
 
-const _State_name = "StateStartStateRestartStateShutdown"
+const _State_name = "StateStartStateRestartStateShutdownStateRestartUnhealthyStateReadyStateRestartFailedStateWorkerExited"
 
-var _State_index = [...]uint8{10, 22, 35}
+var _State_index = [...]uint8{10, 22, 35, 56, 66, 84, 101}
 
 func (i State) String() string {
 	if i >= State(len(_State_index)) {
@@ -0,0 +1,53 @@
+package miyabi
+
+import "net/http"
+
+// Stats represents the statistics of the server returned by Server.Stats.
+type Stats struct {
+	// Requests is the cumulative number of the requests that have been
+	// served.
+	Requests uint64
+
+	// InFlightRequests is the number of the requests being served.
+	InFlightRequests int64
+
+	// Conns is the number of the tracked connections.
+	Conns int
+
+	// ActiveConns is the number of the connections in StateActive.
+	ActiveConns int
+
+	// TruncatedResponses is the cumulative number of the responses that
+	// had begun but were cut off because their connections were closed
+	// forcibly by draining or ActionForceShutdown.
+	TruncatedResponses uint64
+}
+
+// NumActiveConns returns the number of the connections serving a request,
+// i.e. in http.StateActive, which is the same as ActiveConns of Stats. It
+// doesn't take the lock for the connections, so it's cheap enough to be
+// exported as a metric on every scrape. It's safe to call from any
+// goroutine.
+func (srv *Server) NumActiveConns() int {
+	return int(srv.activeConns.Load())
+}
+
+// Stats returns the statistics of the requests and connections served by
+// Serve in the current process. Note that the counters aren't inherited by
+// the new worker on graceful restart.
+func (srv *Server) Stats() Stats {
+	stats := Stats{
+		Requests:           srv.served.Load(),
+		InFlightRequests:   srv.inFlight.Load(),
+		TruncatedResponses: srv.truncated.Load(),
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	stats.Conns = len(srv.conns)
+	for _, tc := range srv.conns {
+		if tc.state == http.StateActive {
+			stats.ActiveConns++
+		}
+	}
+	return stats
+}
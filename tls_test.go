@@ -0,0 +1,610 @@
+package miyabi_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	return newTestCertificateFor(t, x509.ExtKeyUsageServerAuth)
+}
+
+// newTestCertificateFor returns a self-signed certificate for 127.0.0.1
+// and dnsNames with usage.
+func newTestCertificateFor(t *testing.T, usage x509.ExtKeyUsage, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "miyabi test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServer_Serve_drainHandshake(t *testing.T) {
+	for _, v := range []struct {
+		handshake bool
+		expect    time.Duration
+	}{
+		{true, 0},
+		{false, 300 * time.Millisecond},
+	} {
+		func() {
+			server := &miyabi.Server{
+				Server: http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "ok")
+				}), ErrorLog: log.New(io.Discard, "", 0)},
+				DrainHandshakeTimeout: 300 * time.Millisecond,
+			}
+			l := newTestListener(t)
+			defer l.Close()
+			config := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+			done := make(chan error, 1)
+			go func() {
+				done <- server.Serve(tls.NewListener(l, config))
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.WaitReady(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// The connection doesn't begin the handshake until the shutdown.
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// The connections are accepted in order, so conn is tracked once
+			// the request on another connection is served.
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				DisableKeepAlives: true,
+			}}
+			res, err := client.Get("https://" + l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			start := time.Now()
+			go server.Shutdown(ctx)
+			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-server.Done():
+				t.Fatal("server.Serve returned before the handshake")
+			default:
+			}
+			if v.handshake {
+				tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+				if _, err := io.WriteString(tc, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+					t.Fatal(err)
+				}
+				res, err := http.ReadResponse(bufio.NewReader(tc), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if actual, expect := string(body), "ok"; actual != expect {
+					t.Errorf("response body => %q; want %q", actual, expect)
+				}
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("server.Serve(l) => %#v; want nil", err)
+				}
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+			if elapsed := time.Since(start); elapsed < v.expect {
+				t.Errorf("drain took %v; want at least %v", elapsed, v.expect)
+			}
+			if !v.handshake {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("read from the connection in handshake => %v; want %v", err, io.EOF)
+				}
+			}
+		}()
+	}
+}
+
+// writeTLSFiles writes the PEM files of the server certificate and key as
+// cert.pem and key.pem, and the certificate of the client CA as ca.pem
+// into dir.
+func writeTLSFiles(t *testing.T, dir string, server, clientCA tls.Certificate) {
+	key, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: server.Certificate[0]},
+		"key.pem":  {Type: "PRIVATE KEY", Bytes: key},
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: clientCA.Certificate[0]},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// mutualTLSConfig returns the TLS configuration that requires the client
+// certificates signed by ca.pem in dir.
+func mutualTLSConfig(dir string) (*tls.Config, error) {
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	return &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}, nil
+}
+
+func TestServer_ListenAndServeTLS_mutualTLSRestart(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, clientCert := newTestCertificate(t), newTestCertificateFor(t, x509.ExtKeyUsageClientAuth)
+	writeTLSFiles(t, dir, serverCert, clientCert)
+	t.Setenv("MIYABI_TEST_TLS_DIR", dir)
+	config, err := mutualTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t), TLSConfig: config}}
+	states, stop := startMasterFunc(t, func() error {
+		return server.ListenAndServeTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	})
+	defer stop()
+	roots := x509.NewCertPool()
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(leaf)
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		res, err := client.Get("https://" + server.Addr)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+	check := func(when string) string {
+		pid, err := get(clientCert)
+		if err != nil {
+			t.Fatalf("GET with the client certificate %s => %v; want success", when, err)
+		}
+		if _, err := get(); err == nil {
+			t.Errorf("GET without the client certificate %s succeeded; want failure", when)
+		}
+		return pid
+	}
+	pid := check("before restart")
+	signalSelf(t, miyabi.RestartSignal)
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Fatalf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if actual := check("after restart"); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+}
+
+func TestServer_ListenAndServeTLS_SNI(t *testing.T) {
+	certA := newTestCertificateFor(t, x509.ExtKeyUsageServerAuth, "a.example")
+	certB := newTestCertificateFor(t, x509.ExtKeyUsageServerAuth, "b.example")
+	fileCert := newTestCertificate(t)
+	dir := t.TempDir()
+	writeTLSFiles(t, dir, fileCert, fileCert)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for _, v := range []struct {
+		name              string
+		config            *tls.Config
+		certFile, keyFile string
+		expect            map[string]tls.Certificate
+	}{
+		{"GetCertificate", &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName == "b.example" {
+					return &certB, nil
+				}
+				return &certA, nil
+			},
+		}, "", "", map[string]tls.Certificate{"a.example": certA, "b.example": certB}},
+		{"Certificates", &tls.Config{
+			Certificates: []tls.Certificate{certA, certB},
+		}, certFile, keyFile, map[string]tls.Certificate{"a.example": certA, "b.example": certB, "": fileCert}},
+	} {
+		func() {
+			l := newTestListener(t)
+			defer l.Close()
+			defer inheritListener(t, l)()
+			server := &miyabi.Server{Server: http.Server{
+				Addr:      l.Addr().String(),
+				Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				TLSConfig: v.config,
+			}}
+			go server.ListenAndServeTLS(v.certFile, v.keyFile)
+			defer server.Shutdown(context.Background())
+			if err := server.WaitReady(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for serverName, expect := range v.expect {
+				conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+				if err != nil {
+					t.Fatalf("%s: tls.Dial with %q => %v", v.name, serverName, err)
+				}
+				actual := conn.ConnectionState().PeerCertificates[0].Raw
+				conn.Close()
+				if !bytes.Equal(actual, expect.Certificate[0]) {
+					t.Errorf("%s: certificate for %q isn't the expected one", v.name, serverName)
+				}
+			}
+		}()
+	}
+}
+
+func TestServer_ReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, newCert := newTestCertificate(t), newTestCertificate(t)
+	clientCert := newTestCertificateFor(t, x509.ExtKeyUsageClientAuth)
+	writeTLSFiles(t, dir, oldCert, clientCert)
+	t.Setenv("MIYABI_TEST_TLS_DIR", dir)
+	config, err := mutualTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t), TLSConfig: config}}
+	_, stop := startMasterFunc(t, func() error {
+		return server.ListenAndServeTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	})
+	defer stop()
+	roots := x509.NewCertPool()
+	for _, cert := range []tls.Certificate{oldCert, newCert} {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots.AddCert(leaf)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+		DisableKeepAlives: true,
+	}}
+	// get returns the worker pid and the certificate presented by the
+	// server.
+	get := func(path string) (string, []byte) {
+		res, err := client.Get("https://" + server.Addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s => %v %s", path, res.Status, body)
+		}
+		return string(body), res.TLS.PeerCertificates[0].Raw
+	}
+	pid, actual := get("/")
+	if !bytes.Equal(actual, oldCert.Certificate[0]) {
+		t.Fatalf("certificate before reload isn't the old one")
+	}
+	writeTLSFiles(t, dir, newCert, clientCert)
+	get("/reload-tls")
+	newPID, actual := get("/")
+	if !bytes.Equal(actual, newCert.Certificate[0]) {
+		t.Errorf("certificate after reload isn't the new one")
+	}
+	if newPID != pid {
+		t.Errorf("worker pid => %v after reload; want %v", newPID, pid)
+	}
+}
+
+func TestServer_ServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, newCert := newTestCertificate(t), newTestCertificate(t)
+	writeTLSFiles(t, dir, oldCert, newTestCertificate(t))
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	server := &miyabi.Server{Server: http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}),
+	}}
+	l := newTestListener(t)
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeTLS(l, certFile, keyFile)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	get := func() []byte {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		res, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual, expect := string(body), "hello"; actual != expect {
+			t.Errorf("GET => %q; want %q", actual, expect)
+		}
+		return res.TLS.PeerCertificates[0].Raw
+	}
+	if !bytes.Equal(get(), oldCert.Certificate[0]) {
+		t.Errorf("the certificate isn't the one in %v", certFile)
+	}
+	writeTLSFiles(t, dir, newCert, newTestCertificate(t))
+	if err := server.ReloadTLS(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(get(), newCert.Certificate[0]) {
+		t.Errorf("the certificate hasn't been reloaded")
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("server.Shutdown(ctx) => %v; want nil", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server.ServeTLS(l, %q, %q) => %#v; want nil", certFile, keyFile, err)
+	}
+
+	l = newTestListener(t)
+	defer l.Close()
+	missing := filepath.Join(dir, "missing.pem")
+	if err := server.ServeTLS(l, missing, keyFile); err == nil {
+		t.Errorf("server.ServeTLS(l, %q, %q) => nil; want error", missing, keyFile)
+	}
+}
+
+func TestServer_ServeTLS_minReadRate(t *testing.T) {
+	dir := t.TempDir()
+	writeTLSFiles(t, dir, newTestCertificate(t), newTestCertificate(t))
+	var buf syncBuffer
+	// The rate includes the overhead of the TLS records, which is sent for
+	// each byte below.
+	server := &miyabi.Server{MinReadRate: 1000}
+	server.Logger = log.New(&buf, "", 0)
+	l := newTestListener(t)
+	defer l.Close()
+	go server.ServeTLS(l, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closed := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+	start := time.Now()
+	header := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+loop:
+	for i := 0; i < len(header); i++ {
+		if _, err := io.WriteString(conn, header[i:i+1]); err != nil {
+			break
+		}
+		select {
+		case <-closed:
+			break loop
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("slow TLS connection was closed after %v; want within %v", elapsed, 3*time.Second)
+	}
+	if actual, expect := buf.String(), "closing slow connection"; !strings.Contains(actual, expect) {
+		t.Errorf("log => %q; want to contain %q", actual, expect)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("GET by the client that isn't slow => %v; want nil", err)
+	}
+	res.Body.Close()
+}
+
+func TestServer_ListenAndServeTLS_http2(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCertificate(t)
+	writeTLSFiles(t, dir, cert, cert)
+	for _, v := range []struct {
+		disableHTTP2     bool
+		expect           string
+		expectInterfaces string
+	}{
+		{false, "HTTP/2.0", "Flusher Pusher"},
+		{true, "HTTP/1.1", "Flusher Hijacker ReaderFrom"},
+	} {
+		func() {
+			l := newTestListener(t)
+			defer l.Close()
+			defer inheritListener(t, l)()
+			started := make(chan struct{}, 1)
+			release := make(chan struct{})
+			server := &miyabi.Server{
+				Server: http.Server{
+					Addr: l.Addr().String(),
+					Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if r.URL.Path == "/slow" {
+							started <- struct{}{}
+							<-release
+						}
+						if r.URL.Path == "/interfaces" {
+							io.WriteString(w, optionalInterfaces(w))
+							return
+						}
+						io.WriteString(w, r.Proto)
+					}),
+				},
+				DisableHTTP2: v.disableHTTP2,
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- server.ListenAndServeTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+			}()
+			if err := server.WaitReady(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			}}
+			defer client.CloseIdleConnections()
+			res, err := client.Get("https://" + l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.Proto != v.expect {
+				t.Errorf("DisableHTTP2 %v: protocol => %v; want %v", v.disableHTTP2, res.Proto, v.expect)
+			}
+			if res, err = client.Get("https://" + l.Addr().String() + "/interfaces"); err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := string(body); actual != v.expectInterfaces {
+				t.Errorf("DisableHTTP2 %v: optional interfaces of ResponseWriter => %q; want %q", v.disableHTTP2, actual, v.expectInterfaces)
+			}
+			// The in-flight request is drained on shutdown.
+			result := make(chan string, 1)
+			go func() {
+				res, err := client.Get("https://" + l.Addr().String() + "/slow")
+				if err != nil {
+					result <- err.Error()
+					return
+				}
+				defer res.Body.Close()
+				body, _ := io.ReadAll(res.Body)
+				result <- string(body)
+			}()
+			<-started
+			go server.Shutdown(context.Background())
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			if actual := <-result; actual != v.expect {
+				t.Errorf("DisableHTTP2 %v: response while draining => %q; want %q", v.disableHTTP2, actual, v.expect)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("DisableHTTP2 %v: ListenAndServeTLS => %v; want nil", v.disableHTTP2, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("DisableHTTP2 %v: ListenAndServeTLS hasn't returned after drained", v.disableHTTP2)
+			}
+		}()
+	}
+}
+
+func TestServer_ListenAndServeTLS_config(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCertificate(t)
+	writeTLSFiles(t, dir, cert, cert)
+	l := newTestListener(t)
+	defer l.Close()
+	defer inheritListener(t, l)()
+	server := &miyabi.Server{Server: http.Server{
+		Addr:      l.Addr().String(),
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS13},
+		// The handshake error of the TLS 1.2 client is expected.
+		ErrorLog: log.New(io.Discard, "", 0),
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){
+			"miyabi-test": func(s *http.Server, c *tls.Conn, h http.Handler) {
+				io.WriteString(c, "custom")
+				c.Close()
+			},
+		},
+	}}
+	go server.ListenAndServeTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	defer server.Shutdown(context.Background())
+	if err := server.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		conn.Close()
+		t.Errorf("tls.Dial with TLS 1.2 => nil; want error")
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"miyabi-test"}})
+	if err != nil {
+		t.Fatalf("tls.Dial with TLS 1.3 => %v; want nil", err)
+	}
+	defer conn.Close()
+	if actual, expect := conn.ConnectionState().NegotiatedProtocol, "miyabi-test"; actual != expect {
+		t.Errorf("negotiated protocol => %q; want %q", actual, expect)
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, expect := string(b), "custom"; actual != expect {
+		t.Errorf("response of TLSNextProto => %q; want %q", actual, expect)
+	}
+}
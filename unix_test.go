@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package miyabi_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+func TestServer_ListenAndServe_unix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "sock")
+	// Leave a stale socket file as if the previous server has crashed.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	server := &miyabi.Server{Server: http.Server{Addr: "unix:" + sock}}
+	states, stop := startMaster(t, server)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+		DisableKeepAlives: true,
+	}}
+	get := func() string {
+		res, err := client.Get("http://miyabi/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	pid := get()
+	if err := server.Restart(); err != nil {
+		t.Fatalf("server.Restart() => %v; want nil", err)
+	}
+	select {
+	case state := <-states:
+		if state != miyabi.StateRestart {
+			t.Errorf("state => %v; want %v", state, miyabi.StateRestart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	// The socket file must survive the old worker closing its listener.
+	if actual := get(); actual == pid {
+		t.Errorf("worker pid => %v after restart; want a new worker", actual)
+	}
+	stop()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) after shutdown => %v; want not exist", sock, err)
+	}
+}
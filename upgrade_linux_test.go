@@ -0,0 +1,107 @@
+package miyabi_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/naoina/miyabi"
+)
+
+// inodeOf returns the inode number of the file at path.
+func inodeOf(t *testing.T, path string) uint64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
+
+// copyBinary copies the test binary to path through a temporary file, so
+// that path is replaced by the new inode as deploys do.
+func copyBinary(t *testing.T, path string) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".new", b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_Restart_upgrade(t *testing.T) {
+	// The master runs from the copy of the test binary, so that the test
+	// can replace it.
+	path := filepath.Join(t.TempDir(), "miyabi.test")
+	copyBinary(t, path)
+	cmd := exec.Command(path, "-test.run=^TestServer_Restart_upgradeHelper$")
+	cmd.Env = append(os.Environ(), "MIYABI_TEST_UPGRADE=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if expect := "upgraded\n"; !strings.Contains(string(out), expect) {
+		t.Errorf("master output => %q; want to contain %q", out, expect)
+	}
+}
+
+func TestServer_Restart_upgradeHelper(t *testing.T) {
+	if os.Getenv("MIYABI_TEST_UPGRADE") == "" {
+		return
+	}
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &miyabi.Server{Server: http.Server{Addr: freeAddr(t)}}
+	states, stop := startMaster(t, server)
+	defer stop()
+	restart := func(expect miyabi.State) {
+		if err := server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case state := <-states:
+			if state != expect {
+				t.Fatalf("state => %v; want %v", state, expect)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	// workerInode returns the inode of the binary that the worker runs,
+	// which remains even if it has been replaced or removed.
+	workerInode := func() (string, uint64) {
+		pid := waitServing(t, server.Addr)
+		return pid, inodeOf(t, fmt.Sprintf("/proc/%s/exe", pid))
+	}
+	_, old := workerInode()
+	copyBinary(t, path)
+	upgraded := inodeOf(t, path)
+	restart(miyabi.StateRestart)
+	pid, actual := workerInode()
+	if actual != upgraded || actual == old {
+		t.Errorf("inode of the worker binary => %v after upgrade; want %v", actual, upgraded)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	restart(miyabi.StateRestartFailed)
+	if actual, _ := workerInode(); actual != pid {
+		t.Errorf("worker pid => %v after the binary is removed; want %v", actual, pid)
+	}
+	fmt.Println("upgraded")
+}